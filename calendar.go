@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var /* const */ calendarFormats = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+//calendarTime is a local date ("2006-01-02") or date and time ("2006-01-02 15:04") in the config
+type calendarTime struct {
+	time.Time
+	// dateOnly times are the start of their day, as an end they include the whole day
+	dateOnly bool
+}
+
+func (c *calendarTime) UnmarshalText(text []byte) error {
+	for _, format := range calendarFormats {
+		t, err := time.ParseInLocation(format, string(text), time.Local)
+		if err == nil {
+			c.Time = t
+			c.dateOnly = len(format) == len("2006-01-02")
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid date %q, expected eg 2018-06-01 or 2018-06-01 17:30", text)
+}
+
+func (c calendarTime) String() string {
+	if c.dateOnly {
+		return c.Format("2006-01-02")
+	}
+	return c.Format("2006-01-02 15:04:05")
+}
+
+// end returns the time at which a period ending on c is over
+func (c calendarTime) end() time.Time {
+	if c.dateOnly {
+		return c.AddDate(0, 0, 1)
+	}
+	return c.Time
+}
+
+//Blackout is a period during which cameras don't capture, eg while the growth chamber is cleaned
+type Blackout struct {
+	From, Until calendarTime
+	Reason      string
+}
+
+//Calendar limits captures to an experiment period, minus any blackouts
+type Calendar struct {
+	StartDate, EndDate calendarTime
+	Blackouts          []Blackout
+}
+
+// inherit fills in the experiment period from parent if it isn't set and adds the blackouts of parent
+func (cal *Calendar) inherit(parent *Calendar) {
+	if cal.StartDate.IsZero() {
+		cal.StartDate = parent.StartDate
+	}
+	if cal.EndDate.IsZero() {
+		cal.EndDate = parent.EndDate
+	}
+	cal.Blackouts = append(cal.Blackouts, parent.Blackouts...)
+}
+
+// state returns whether cameras should capture at t, and if not the reason why
+func (cal *Calendar) state(t time.Time) (active bool, reason string) {
+	if !cal.StartDate.IsZero() && t.Before(cal.StartDate.Time) {
+		return false, fmt.Sprintf("experiment starts %s", cal.StartDate)
+	}
+	if !cal.EndDate.IsZero() && !t.Before(cal.EndDate.end()) {
+		return false, fmt.Sprintf("experiment ended %s", cal.EndDate)
+	}
+	for _, b := range cal.Blackouts {
+		if !t.Before(b.From.Time) && t.Before(b.Until.end()) {
+			if b.Reason == "" {
+				return false, fmt.Sprintf("blackout until %s", b.Until)
+			}
+			return false, fmt.Sprintf("blackout until %s (%s)", b.Until, b.Reason)
+		}
+	}
+	return true, "active"
+}
+
+// inCalendar returns whether the timepoint is inside the cameras experiment calendar.
+// Changes between active and idle are logged.
+func (c *CameraConfig) inCalendar(timepoint time.Time) bool {
+	active, reason := c.Calendar.state(timepoint)
+	// cameras start out active, only log when that changes
+	if reason != c.calendarState && (c.calendarState != "" || !active) {
+		if active {
+			infoLog.Printf("%s is active\n", c.FilenamePrefix)
+		} else {
+			infoLog.Printf("%s is idle: %s\n", c.FilenamePrefix, reason)
+		}
+		c.calendarState = reason
+	}
+	return active
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+//Camera is implemented by every camera type that go-eyepi can schedule
+type Camera interface {
+	// Config returns the settings shared by all camera types
+	Config() *CameraConfig
+	// capture takes the images for a single timepoint, named with timestamp.
+	// Cancelling ctx kills the capture.
+	capture(ctx context.Context, timestamp string) error
+	// Describe returns a human readable summary of the camera and its settings
+	Describe() string
+	// Health returns an error if the camera is not currently able to capture
+	Health(ctx context.Context) error
+}
+
+//CameraConfig holds the settings every camera type reads from its TOML table
+type CameraConfig struct {
+	Enable   bool
+	Interval duration
+	// Schedule replaces Interval with cron expressions (with seconds) when set, the camera captures at every
+	// timepoint matched by any of them
+	Schedule []cronSchedule
+	// Latitude and Longitude in degrees locate the camera for CaptureFrom and CaptureUntil
+	Latitude, Longitude float64
+	// CaptureFrom and CaptureUntil limit captures to a daily window relative to sunrise and sunset
+	CaptureFrom, CaptureUntil solarTime
+	// Calendar limits the camera to an experiment period, it inherits the period and blackouts of the GlobalConfig
+	Calendar
+	// OverrunPolicy decides what happens to timepoints missed during a capture that took too long, see overrunPolicy
+	OverrunPolicy overrunPolicy
+	// Retries is how often a capture that failed with a transient error is tried again, waiting RetryBackoff
+	// before the first retry and twice as long before every following one
+	Retries      int
+	RetryBackoff duration
+	// CaptureTimeout is how long a single gphoto2 or raspistill process may run before it is killed
+	CaptureTimeout duration
+	// Burst is the number of frames taken at every timepoint (or for every bracket value)
+	Burst          int
+	FilenamePrefix string
+	OutputDir      string
+
+	// copied from the GlobalConfig, so that running cameras don't need to read it
+	timestampFormat string
+	sysfsRoot       string
+	// the TOML tables the camera was loaded from (the global one and its own), to find changed cameras on reload
+	loadedFrom []map[string]interface{}
+
+	// the capture window of the current day, see inCaptureWindow
+	windowDay               string
+	windowFrom, windowUntil time.Time
+	// the last calendar state, see inCalendar
+	calendarState string
+	// the CameraGroup the camera is a member of, members only capture with their group
+	group string
+	// capture processes killed by the CaptureTimeout since the last measurement
+	timeouts int
+	// time spent waiting for usb locks since the last measurement
+	lockWait time.Duration
+	// files written by the capture in progress
+	files []string
+}
+
+//Config returns the shared camera settings, satisfies part of the Camera interface
+func (c *CameraConfig) Config() *CameraConfig {
+	return c
+}
+
+// fillDefaults sets the FilenamePrefix, OutputDir and Interval of cameras that didn't specify them
+func (c *CameraConfig) fillDefaults(hostname, name string) {
+	if c.FilenamePrefix == "" {
+		c.FilenamePrefix = hostname + "-" + name
+	}
+	if c.OutputDir == "" {
+		c.OutputDir = filepath.Join("/var/lib/eyepi/", c.FilenamePrefix)
+	}
+	if c.Interval.Duration <= time.Duration(time.Second) {
+		c.Interval.Duration = time.Duration(time.Minute * 10)
+	}
+	if c.Burst < 1 {
+		c.Burst = 1
+	}
+	if c.RetryBackoff.Duration <= 0 {
+		c.RetryBackoff.Duration = time.Duration(time.Second * 5)
+	}
+	if c.CaptureTimeout.Duration == 0 {
+		c.CaptureTimeout.Duration = time.Duration(time.Minute * 2)
+	}
+	if c.OverrunPolicy == "" {
+		c.OverrunPolicy = overrunQueue
+	}
+}
+
+// frameName returns the filename without extension for one of the frames of a timepoint.
+// Frames are only numbered if there are several, so that single captures keep the usual name.
+func (c *CameraConfig) frameName(timestamp string, index, frames int) string {
+	if frames <= 1 {
+		return fmt.Sprintf("%s_%s", c.FilenamePrefix, timestamp)
+	}
+	return fmt.Sprintf("%s_%s_%02d", c.FilenamePrefix, timestamp, index)
+}
+
+// describe returns the shared part of Camera.Describe
+func (c *CameraConfig) describe() string {
+	description := fmt.Sprintf("Camera %s \n\t%t\n\t%s\n\t%s", c.FilenamePrefix, c.Enable, c.describeSchedule(), c.OutputDir)
+	if !c.CaptureFrom.isZero() || !c.CaptureUntil.isZero() {
+		from, until := c.captureWindow(time.Now())
+		description += fmt.Sprintf("\n\tcapturing %s to %s today at %.4f,%.4f",
+			from.Format("15:04:05"), until.Format("15:04:05"), c.Latitude, c.Longitude)
+	}
+	_, state := c.Calendar.state(time.Now())
+	return description + "\n\t" + state
+}
+
+//cameraBackend describes how cameras of one type are created from their TOML section
+type cameraBackend struct {
+	// single backends have exactly one camera configured by a plain table ([rpicamera]) which always exists,
+	// otherwise the section holds a table per camera ([gphoto.camera1])
+	single bool
+	// label replaces the camera name in the default FilenamePrefix of single backends
+	label string
+	// newCamera returns a camera with its type specific defaults set, ready to be decoded into
+	newCamera func() Camera
+}
+
+var cameraBackends = make(map[string]cameraBackend)
+
+//registerCameraBackend makes a camera type available under a TOML section
+func registerCameraBackend(section string, backend cameraBackend) {
+	if _, exists := cameraBackends[section]; exists {
+		panic("camera backend registered twice: " + section)
+	}
+	cameraBackends[section] = backend
+}
+
+// removeFrame deletes the files of an interrupted frame, whatever their extension
+func removeFrame(dir, name string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, name+".*"))
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// sameSettings returns whether a and b were loaded from identical configuration and are members of the same group,
+// a camera that joined or left a group runs differently although its own table didn't change
+func sameSettings(a, b Camera) bool {
+	return reflect.TypeOf(a) == reflect.TypeOf(b) && a.Config().group == b.Config().group &&
+		reflect.DeepEqual(a.Config().loadedFrom, b.Config().loadedFrom)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mdaffin/go-telegraf"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cardRecordFilename = "card_files.json"
+
+var /* const */ cardFileRegexp = regexp.MustCompile(`(?m)^New file is in location (.+?) on the camera\r?$`)
+var /* const */ listFolderRegexp = regexp.MustCompile(`^There (?:is|are) \d+ files? in folder '(.+)':`)
+var /* const */ listFileRegexp = regexp.MustCompile(`^#(\d+)\s+(\S+)`)
+
+//cardRecord is the record of the frames a camera captured to its card, kept in its output directory so that
+//a restarted go-eyepi neither misses nor downloads them again
+type cardRecord struct {
+	// Pending are the card files still to download, with the name of the frame they are downloaded as
+	Pending map[string]string
+	// Fetched are the card files downloaded, with the file they were saved to. They are forgotten once they are
+	// no longer on the card, the camera may reuse their names.
+	Fetched map[string]string
+
+	path string
+}
+
+// loadCardRecord reads the card record of the camera, an empty one if there is none yet
+func (c *CameraConfig) loadCardRecord() (*cardRecord, error) {
+	record := &cardRecord{path: filepath.Join(c.OutputDir, cardRecordFilename)}
+	data, err := ioutil.ReadFile(record.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, record); err != nil {
+			return nil, fmt.Errorf("%s: %s", record.path, err)
+		}
+	}
+	if record.Pending == nil {
+		record.Pending = make(map[string]string)
+	}
+	if record.Fetched == nil {
+		record.Fetched = make(map[string]string)
+	}
+	return record, nil
+}
+
+// save writes the record next to it and renames it over, so that it is never read half written
+func (r *cardRecord) save() error {
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(r.path+".part", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(r.path+".part", r.path)
+}
+
+// parseCardFiles returns the files gphoto2 captured to the card, from the "New file is in location ..." lines
+func parseCardFiles(output string) (files []string) {
+	for _, m := range cardFileRegexp.FindAllStringSubmatch(output, -1) {
+		files = append(files, m[1])
+	}
+	return
+}
+
+//cardFile is a file on the card of a camera, with its number in its folder as gphoto2 --list-files prints it
+type cardFile struct {
+	path  string
+	index int
+}
+
+// parseFileList returns the files on the card by their path, from the output of gphoto2 --list-files
+func parseFileList(output string) map[string]cardFile {
+	files := make(map[string]cardFile)
+	var folder string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := listFolderRegexp.FindStringSubmatch(line); m != nil {
+			folder = m[1]
+			continue
+		}
+		if m := listFileRegexp.FindStringSubmatch(line); m != nil && folder != "" {
+			index, _ := strconv.Atoi(m[1])
+			p := path.Join(folder, m[2])
+			files[p] = cardFile{path: p, index: index}
+		}
+	}
+	return files
+}
+
+// recordCardFiles adds the files a frame was captured to on the card to the pending downloads
+func (cam *GphotoCamera) recordCardFiles(files []string, name string) error {
+	record, err := cam.loadCardRecord()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		record.Pending[file] = name
+		// the camera reused the name of a file that is gone
+		delete(record.Fetched, file)
+	}
+	return record.save()
+}
+
+// download downloads the frames on the card and measures how it went, see maintain
+func (cam *GphotoCamera) download(ctx context.Context, measurements chan<- telegraf.Measurement) {
+	start := time.Now()
+	downloaded, err := cam.downloadFromCard(ctx)
+	cam.handleCaptureError(ctx, err)
+
+	m := telegraf.MeasureInt("camera", "downloaded_files", len(downloaded))
+	m.AddFloat64("timing_download_s", time.Since(start).Seconds())
+	if err != nil {
+		errLog.Printf("%s download from the card failed after %d files (%s): %s\n",
+			cam.FilenamePrefix, len(downloaded), errorKind(err), err)
+		m.AddTag("error", errorKind(err))
+	} else if len(downloaded) > 0 {
+		infoLog.Printf("%s downloaded %d files from the card in %s\n", cam.FilenamePrefix, len(downloaded), time.Since(start))
+	}
+	if record, err := cam.loadCardRecord(); err == nil {
+		m.AddInt("card_pending_files", len(record.Pending))
+	}
+	m.AddTag("camera_name", cam.FilenamePrefix)
+	measurements <- m
+}
+
+// downloadFromCard downloads the pending frames on the card a folder at a time and deletes the downloaded ones
+// with DeleteFromCard. Every file is recorded as soon as its folder is downloaded, so that a failed batch
+// only leaves the files it didn't get to pending. The files downloaded before a failure are post processed
+// all the same, they aren't downloaded again. It returns the files it wrote.
+func (cam *GphotoCamera) downloadFromCard(ctx context.Context) (downloaded []string, err error) {
+	record, err := cam.loadCardRecord()
+	if err != nil {
+		return nil, err
+	}
+	if len(record.Pending) == 0 && (!cam.DeleteFromCard || len(record.Fetched) == 0) {
+		return nil, nil
+	}
+	if err := cam.findPort(ctx); err != nil {
+		return nil, err
+	}
+	listing, err := cam.gphoto2(ctx, "--list-files")
+	if err != nil {
+		return nil, err
+	}
+	onCard := parseFileList(listing)
+
+	for file := range record.Fetched {
+		if _, exists := onCard[file]; !exists {
+			delete(record.Fetched, file)
+		}
+	}
+	batches := make(map[string][]cardFile)
+	for file := range record.Pending {
+		f, exists := onCard[file]
+		if !exists {
+			warnLog.Printf("%s %s is no longer on the card\n", cam.FilenamePrefix, file)
+			delete(record.Pending, file)
+			continue
+		}
+		batches[path.Dir(file)] = append(batches[path.Dir(file)], f)
+	}
+
+	// gphoto2 saves them under their card name, they are renamed after the frame
+	staging := filepath.Join(cam.OutputDir, ".card")
+	if err := os.MkdirAll(staging, 0777); err != nil {
+		return nil, err
+	}
+	downloaded, err = cam.downloadBatches(ctx, record, batches, staging)
+	cam.updateLastImage(downloaded)
+	downloaded = append(downloaded, cam.postProcess(downloaded)...)
+
+	if err == nil && cam.DeleteFromCard {
+		err = cam.deleteFromCard(ctx, record, onCard)
+	}
+	return downloaded, err
+}
+
+// downloadBatches downloads the files of every folder with a single gphoto2 call into staging and renames them
+// after their frame. It stops at the first folder that fails and returns the files it wrote until then.
+func (cam *GphotoCamera) downloadBatches(ctx context.Context, record *cardRecord, batches map[string][]cardFile,
+	staging string) (downloaded []string, err error) {
+	for _, folder := range sortedFolders(batches) {
+		files := batches[folder]
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].index < files[j].index
+		})
+		indexes := make([]string, len(files))
+		for i, f := range files {
+			indexes[i] = strconv.Itoa(f.index)
+		}
+		output, getErr := cam.gphoto2(ctx, "--folder", folder, "--get-file", strings.Join(indexes, ","),
+			"--filename", filepath.Join(staging, "%f.%C"), "--force-overwrite")
+
+		saved := make(map[string]string)
+		for _, s := range parseSavedFiles(output) {
+			saved[strings.ToLower(filepath.Base(s))] = s
+		}
+		for _, f := range files {
+			staged, exists := saved[strings.ToLower(path.Base(f.path))]
+			if !exists {
+				continue
+			}
+			target := filepath.Join(cam.OutputDir, record.Pending[f.path]+strings.ToLower(path.Ext(f.path)))
+			if err := os.Rename(staged, target); err != nil {
+				record.save()
+				return downloaded, err
+			}
+			record.Fetched[f.path] = target
+			delete(record.Pending, f.path)
+			downloaded = append(downloaded, target)
+		}
+		// what it got is recorded even if the batch failed
+		if err := record.save(); err != nil {
+			return downloaded, err
+		}
+		if getErr != nil {
+			return downloaded, getErr
+		}
+	}
+	return downloaded, nil
+}
+
+// deleteFromCard deletes the fetched files from the card. They are deleted one at a time from the last of
+// their folder, as deleting a file renumbers the ones after it.
+func (cam *GphotoCamera) deleteFromCard(ctx context.Context, record *cardRecord, onCard map[string]cardFile) error {
+	var files []cardFile
+	for file := range record.Fetched {
+		files = append(files, onCard[file])
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].index > files[j].index
+	})
+	defer record.save()
+	for _, f := range files {
+		if _, err := cam.gphoto2(ctx, "--folder", path.Dir(f.path), "--delete-file", strconv.Itoa(f.index)); err != nil {
+			return err
+		}
+		delete(record.Fetched, f.path)
+	}
+	return nil
+}
+
+// updateLastImage makes last_image.jpg from the latest frame downloaded from the card
+func (cam *GphotoCamera) updateLastImage(files []string) {
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+	var latest []string
+	for _, file := range sorted {
+		name := strings.TrimSuffix(file, filepath.Ext(file))
+		if len(latest) > 0 && name != strings.TrimSuffix(latest[0], filepath.Ext(latest[0])) {
+			latest = nil
+		}
+		latest = append(latest, file)
+	}
+	if frame := previewFile(latest); frame != "" {
+		if err := cam.timestampLast(frame); err != nil {
+			warnLog.Printf("%s last_image.jpg not updated: %s\n", cam.FilenamePrefix, err)
+		}
+	}
+}
+
+func sortedFolders(batches map[string][]cardFile) []string {
+	folders := make([]string, 0, len(batches))
+	for folder := range batches {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	return folders
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+//command is an operator subcommand of go-eyepi, eg `go-eyepi status`
+type command struct {
+	usage       string
+	description string
+	run         func(c *GlobalConfig, args []string) error
+}
+
+var commands = map[string]command{
+	"list": {
+		usage:       "list",
+		description: "print the configured cameras and their settings",
+		run:         listCommand,
+	},
+	"capture": {
+		usage:       "capture <camera>",
+		description: "capture a single timepoint now, waiting for the running daemon to release the cameras",
+		run:         captureCommand,
+	},
+	"detect": {
+		usage:       "detect",
+		description: "print the gphoto2 cameras connected with their ports, usb paths and ids, serial numbers and configured names",
+		run:         detectCommand,
+	},
+	"camera-config": {
+		usage:       "camera-config <camera>",
+		description: "print every gphoto2 config of a camera with its value and choices",
+		run:         cameraConfigCommand,
+	},
+	"discover": {
+		usage:       "discover [--write]",
+		description: "print config for the connected gphoto2 cameras that aren't configured, --write adds it to the config",
+		run:         discoverCommand,
+	},
+	"focus": {
+		usage:       "focus <camera>",
+		description: "print the focus score of a live view frame every second until interrupted, higher is sharper",
+		run:         focusCommand,
+	},
+	"status": {
+		usage:       "status",
+		description: "print the last capture of every camera and its next timepoint",
+		run:         statusCommand,
+	},
+}
+
+// commandUsage prints the subcommands after the flags
+func commandUsage() {
+	fmt.Fprintf(os.Stderr, "usage: go-eyepi [flags] [command]\n\nwithout a command go-eyepi runs the cameras\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", commands[name].usage, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+}
+
+// runCommand loads the configuration file and runs the subcommand args[0] with the rest of args
+func runCommand(args []string) error {
+	cmd, exists := commands[args[0]]
+	if !exists {
+		return fmt.Errorf("unknown command %s, see go-eyepi -h", args[0])
+	}
+	c, err := loadConfig(CONFIGPATH)
+	if err != nil {
+		return fmt.Errorf("invalid configuration %s:\n%s", CONFIGPATH, err)
+	}
+	config = c
+	return cmd.run(c, args[1:])
+}
+
+// sortedCameras returns the names of the cameras of c in order
+func sortedCameras(c *GlobalConfig) []string {
+	names := make([]string, 0, len(c.Cameras))
+	for name := range c.Cameras {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// backendOf returns the section of the backend cam was loaded from
+func backendOf(cam Camera) string {
+	for section, backend := range cameraBackends {
+		if reflect.TypeOf(backend.newCamera()) == reflect.TypeOf(cam) {
+			return section
+		}
+	}
+	return "unknown"
+}
+
+func listCommand(c *GlobalConfig, args []string) error {
+	for _, name := range sortedCameras(c) {
+		cam := c.Cameras[name]
+		cc := cam.Config()
+		fmt.Printf("%s (%s)\n\t%s\n", name, backendOf(cam), cam.Describe())
+		fmt.Printf("\tburst %d, %d retries after %s, overrun policy %s\n",
+			cc.Burst, cc.Retries, cc.RetryBackoff, cc.OverrunPolicy)
+	}
+	return nil
+}
+
+func captureCommand(c *GlobalConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: go-eyepi capture <camera>")
+	}
+	cam, exists := c.Cameras[args[0]]
+	if !exists {
+		return fmt.Errorf("no camera %s in %s, see go-eyepi list", args[0], CONFIGPATH)
+	}
+
+	// interrupting the command kills the capture like stopping the daemon does
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	if err := os.MkdirAll(cam.Config().OutputDir, 0777); err != nil {
+		return err
+	}
+	// the same path as a scheduled capture, the usb lock makes it wait for a capture of the daemon in progress
+	result, _ := runCapture(ctx, ctx, cam, time.Now().Truncate(time.Second))
+	if err := cam.Config().recordStatus(result); err != nil {
+		warnLog.Printf("cannot record the status of %s: %s\n", args[0], err)
+	}
+	if result.Err != nil {
+		return result.Err
+	}
+	fmt.Printf("captured %s to %s in %s\n",
+		args[0], cam.Config().OutputDir, result.Finish.Sub(result.Start).Round(time.Millisecond))
+	for _, file := range result.Files {
+		fmt.Printf("\t%s\n", file)
+	}
+	return nil
+}
+
+func detectCommand(c *GlobalConfig, args []string) error {
+	ctx := context.Background()
+	detected, err := detectCameras(ctx, c.SysfsRoot)
+	if err != nil {
+		return err
+	}
+	if len(detected) == 0 {
+		fmt.Println("no gphoto2 cameras detected")
+	}
+
+	// the configured camera on every port, cameras that can't be told apart are reported
+	configured := make(map[string]string)
+	for _, name := range sortedCameras(c) {
+		if g, ok := c.Cameras[name].(*GphotoCamera); ok {
+			d, err := g.matchCamera(ctx, detected)
+			if err != nil {
+				fmt.Printf("%s\tnot found: %s\n", name, err)
+				continue
+			}
+			configured[d.Port] = name
+		}
+	}
+	for _, d := range detected {
+		serialNumber := d.SerialNumber
+		if serialNumber == "" {
+			serialNumber = "no serial number"
+		}
+		name := configured[d.Port]
+		if name == "" {
+			name = "not configured"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", d.Port, d.USBPath, d.USBID, d.Model, serialNumber, name)
+	}
+
+	for _, name := range sortedCameras(c) {
+		switch c.Cameras[name].(type) {
+		case *GphotoCamera, *CameraGroup:
+			continue
+		}
+		if err := c.Cameras[name].Health(ctx); err != nil {
+			fmt.Printf("%s\tnot available: %s\n", name, err)
+		} else {
+			fmt.Printf("%s\tavailable\n", name)
+		}
+	}
+	return nil
+}
+
+func statusCommand(c *GlobalConfig, args []string) error {
+	now := time.Now()
+	for _, name := range sortedCameras(c) {
+		cc := c.Cameras[name].Config()
+		fmt.Printf("%s\n", name)
+
+		status, err := cc.readStatus()
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("\tno captures yet\n")
+		case err != nil:
+			fmt.Printf("\tcannot read the last capture: %s\n", err)
+		case status.Error != "":
+			fmt.Printf("\tlast capture of %s failed at %s after %d retries: %s\n",
+				status.Timepoint.Format(c.TimestampFormat), status.Finish.Format(time.RFC3339), status.Retries, status.Error)
+		default:
+			fmt.Printf("\tlast capture of %s finished at %s, took %s with %d retries\n",
+				status.Timepoint.Format(c.TimestampFormat), status.Finish.Format(time.RFC3339),
+				status.Finish.Sub(status.Start).Round(time.Millisecond), status.Retries)
+			for _, file := range status.Files {
+				fmt.Printf("\t\t%s\n", filepath.Base(file))
+			}
+		}
+
+		if g, ok := c.Cameras[name].(*GphotoCamera); ok && g.CaptureToCard {
+			if record, err := cc.loadCardRecord(); err != nil {
+				fmt.Printf("\tcannot read the files on the card: %s\n", err)
+			} else {
+				fmt.Printf("\t%d files on the card to download\n", len(record.Pending))
+			}
+		}
+
+		switch next := cc.nextTimepoint(now); {
+		case cc.group != "":
+			fmt.Printf("\tcaptured with %s\n", cc.group)
+		case !cc.Enable:
+			fmt.Printf("\tdisabled\n")
+		case next.IsZero():
+			fmt.Printf("\tno timepoints scheduled\n")
+		default:
+			_, state := cc.Calendar.state(next)
+			fmt.Printf("\tnext timepoint %s, %s\n", next.Format(time.RFC3339), state)
+		}
+	}
+	return nil
+}
+
+func cameraConfigCommand(c *GlobalConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: go-eyepi camera-config <camera>")
+	}
+	cam, isGphoto := c.Cameras[args[0]].(*GphotoCamera)
+	if !isGphoto {
+		return fmt.Errorf("no gphoto camera %s in %s, see go-eyepi list", args[0], CONFIGPATH)
+	}
+	widgets, err := cam.ListConfig(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, w := range widgets {
+		fmt.Printf("%s\n\t%s\n", w.Path, w.describe())
+	}
+	return nil
+}
+
+func focusCommand(c *GlobalConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: go-eyepi focus <camera>")
+	}
+	cam, isGphoto := c.Cameras[args[0]].(*GphotoCamera)
+	if !isGphoto {
+		return fmt.Errorf("no gphoto camera %s in %s, see go-eyepi list", args[0], CONFIGPATH)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	var best float64
+	for ctx.Err() == nil {
+		img, err := cam.capturePreview(ctx)
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			fmt.Printf("%s\tno preview: %s\n", time.Now().Format("15:04:05"), err)
+		default:
+			score := focusScore(img)
+			if score > best {
+				best = score
+			}
+			fmt.Printf("%s\tfocus %.1f\tbest %.1f\n", time.Now().Format("15:04:05"), score, best)
+		}
+		// leaves the bus to a scheduled capture of the daemon waiting for it
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+//detectedCamera is a camera found by gphoto2 --auto-detect
+type detectedCamera struct {
+	Model, Port, SerialNumber string
+	// USBPath and USBID are the usb device of the Port in sysfs, see describeUsbPorts
+	USBPath, USBID string
+	// serialRead is true once the SerialNumber was asked for, some cameras don't have one
+	serialRead bool
+}
+
+// parseAutoDetect returns the cameras listed by gphoto2 --auto-detect, the model is in front of the port
+func parseAutoDetect(output []byte) (cameras []detectedCamera) {
+	for _, line := range strings.Split(string(output), "\n") {
+		loc := usbRegexp.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		cameras = append(cameras, detectedCamera{
+			Model: strings.TrimSpace(line[:loc[0]]),
+			Port:  line[loc[0]:loc[1]],
+		})
+	}
+	return
+}
+
+// detectCameras returns the connected gphoto2 cameras with their serial numbers and usb devices in sysfs under root
+func detectCameras(ctx context.Context, root string) ([]detectedCamera, error) {
+	output, err := runAutoDetect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cameras := parseAutoDetect(output)
+	describeUsbPorts(root, cameras)
+	for i := range cameras {
+		if cameras[i].SerialNumber, err = getSerialNumber(ctx, cameras[i].Port); err != nil {
+			errLog.Printf("cannot read the serial number of the camera on %s: %s\n", cameras[i].Port, err)
+		}
+		cameras[i].serialRead = err == nil
+	}
+	return cameras, nil
+}
+
+// newCameraStanzas returns the TOML for the detected cameras that aren't configured in c yet,
+// named camera1, camera2... after the names already taken. Cameras are found by their serial number, or by their
+// usbpath if they have none or share it with another camera.
+// A detected camera is configured if any configured camera matches it, by whatever it is matched by.
+func newCameraStanzas(ctx context.Context, c *GlobalConfig, detected []detectedCamera) (stanzas string, skipped []string) {
+	// the configured camera on every port
+	configured := make(map[string]string)
+	for _, name := range sortedCameras(c) {
+		g, ok := c.Cameras[name].(*GphotoCamera)
+		if !ok || len(g.matchers()) == 0 {
+			continue
+		}
+		// a camera that matches several can't tell them apart, none of them is new
+		for _, d := range g.matchingCameras(ctx, detected) {
+			if configured[d.Port] == "" {
+				configured[d.Port] = name
+			}
+		}
+	}
+	serials := make(map[string]int)
+	for _, d := range detected {
+		if d.SerialNumber != "" {
+			serials[d.SerialNumber]++
+		}
+	}
+
+	var buf bytes.Buffer
+	n := 1
+	for _, d := range detected {
+		// a serial number shared with another camera doesn't find it
+		bySerial := d.SerialNumber != "" && serials[d.SerialNumber] == 1
+		switch {
+		case configured[d.Port] != "":
+			skipped = append(skipped, fmt.Sprintf("%s on %s is already configured as %s", d.Model, d.Port, configured[d.Port]))
+			continue
+		case !bySerial && d.USBPath == "":
+			skipped = append(skipped, fmt.Sprintf("%s on %s has no unique serial number or usb path to find it by", d.Model, d.Port))
+			continue
+		}
+		for c.Cameras[fmt.Sprintf("camera%d", n)] != nil {
+			n++
+		}
+		name := fmt.Sprintf("camera%d", n)
+		n++
+
+		fmt.Fprintf(&buf, "\n# %s found on %s by go-eyepi discover on %s\n", d.Model, d.Port, time.Now().Format("2006-01-02"))
+		fmt.Fprintf(&buf, "[gphoto.%s]\nenable = true\ninterval = \"10m\"\n", name)
+		if bySerial {
+			fmt.Fprintf(&buf, "gphotoserialnumber = %q\n", d.SerialNumber)
+		} else {
+			// without a serial number of its own the camera is found by the port it is plugged into
+			fmt.Fprintf(&buf, "usbpath = %q\nmodel = %q\n", d.USBPath, d.Model)
+		}
+	}
+	return buf.String(), skipped
+}
+
+// appendToConfig adds text to the end of the configuration file without touching what is already in it.
+// The file is appended to in place rather than replaced, so that a running daemon watching it reloads.
+func appendToConfig(path, text string) error {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		text = "\n" + text
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func discoverCommand(c *GlobalConfig, args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	write := flags.Bool("write", false, "add the new cameras to "+CONFIGPATH)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	detected, err := detectCameras(context.Background(), c.SysfsRoot)
+	if err != nil {
+		return err
+	}
+	stanzas, skipped := newCameraStanzas(context.Background(), c, detected)
+	for _, s := range skipped {
+		fmt.Println("#", s)
+	}
+	if stanzas == "" {
+		fmt.Println("# no new cameras found")
+		return nil
+	}
+	if !*write {
+		fmt.Print(stanzas)
+		fmt.Printf("\n# run go-eyepi discover --write to add these to %s\n", CONFIGPATH)
+		return nil
+	}
+	if err := appendToConfig(CONFIGPATH, stanzas); err != nil {
+		return err
+	}
+	fmt.Print(stanzas)
+	fmt.Printf("\n# added to %s\n", CONFIGPATH)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// capturePreview takes a live view frame with gphoto2 --capture-preview, it neither releases the shutter nor
+// touches the card. The bus is only locked for the frame, so that scheduled captures wait for one frame at most.
+func (cam *GphotoCamera) capturePreview(ctx context.Context) (image.Image, error) {
+	if err := cam.findPort(ctx); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "go-eyepi-preview")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	output, err := cam.gphoto2(ctx, "--capture-preview", "--force-overwrite",
+		"--filename", filepath.Join(dir, "preview.%C"))
+	if err != nil {
+		return nil, err
+	}
+	files := parseSavedFiles(output)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s didn't save a preview", cam.FilenamePrefix)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
+
+// focusScore returns the variance of the Laplacian of the luminance of img, it is higher the sharper the image.
+// Scores are only comparable between frames of the same scene and size.
+func focusScore(img image.Image) float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 3 || h < 3 {
+		return 0
+	}
+	luma := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			// ITU-R BT.601 on 8 bit values
+			luma[y*w+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+		}
+	}
+
+	// the 4 neighbour Laplacian of every pixel that has all its neighbours
+	var sum, sumSquares float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			l := luma[i-w] + luma[i+w] + luma[i-1] + luma[i+1] - 4*luma[i]
+			sum += l
+			sumSquares += l * l
+		}
+	}
+	n := float64((w - 2) * (h - 2))
+	mean := sum / n
+	return sumSquares/n - mean*mean
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/fogleman/gg"
 	"github.com/fsnotify/fsnotify"
@@ -9,13 +12,15 @@ import (
 	_ "golang.org/x/image/bmp" // import for TimestampLast
 	"golang.org/x/image/font/gofont/goregular"
 	_ "golang.org/x/image/tiff"
+	"image"
 	"image/jpeg"
 	"io"
+	"io/ioutil"
 	"log"
 	"log/syslog"
 	"os"
-	"path/filepath"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 	//"github.com/pkg/profile"
 )
@@ -28,7 +33,8 @@ var (
 	warnLog *log.Logger
 	errLog  *log.Logger
 	config  *GlobalConfig
-	mutex   *sync.Mutex
+	// usbLocks serialise the gphoto2 calls on every USB bus
+	usbLocks *usbLockManager
 	// Version and Built are both informational
 	Version string
 	// Built see above
@@ -38,8 +44,16 @@ var (
 //GlobalConfig type to support the configuration of all cameras managed
 type GlobalConfig struct {
 	TimestampFormat string
-	RpiCamera       *RaspberryPiCamera
-	Gphoto          map[string]*GphotoCamera
+	// Calendar sets the experiment period and blackouts of every camera
+	Calendar
+	// ShutdownGrace is how long captures in progress get to finish when go-eyepi is stopped before they are killed
+	ShutdownGrace duration
+	// SysfsRoot is where sysfs is mounted, USB devices of cameras that stopped responding are recovered through it
+	SysfsRoot string
+	// Cameras is filled from the sections of the registered camera backends, keyed by camera name
+	Cameras map[string]Camera `toml:"-"`
+	// Groups are the CameraGroups among the Cameras, keyed by group name
+	Groups map[string]*CameraGroup `toml:"-"`
 }
 
 type duration struct {
@@ -72,11 +86,16 @@ func CopyFile(src, dest string) error {
 
 //TimestampLast takes a jpeg image path, adds a timestamp to the image and writes it out to outputPath
 func TimestampLast(path, outputPathJpeg string) (err error) {
-	timestamp := time.Now().Format(time.UnixDate)
 	img, err := gg.LoadImage(path)
 	if err != nil {
 		return
 	}
+	return timestampImage(img, outputPathJpeg)
+}
+
+// timestampImage adds a timestamp to img and writes it out as a jpeg to outputPathJpeg
+func timestampImage(img image.Image, outputPathJpeg string) (err error) {
+	timestamp := time.Now().Format(time.UnixDate)
 	b := img.Bounds()
 	dc := gg.NewContext(b.Dx(), b.Dy())
 
@@ -100,75 +119,147 @@ func TimestampLast(path, outputPathJpeg string) (err error) {
 		return
 	}
 	defer out.Close()
-	err = jpeg.Encode(out, dc.Image(), &jpeg.Options{jpeg.DefaultQuality})
+	err = jpeg.Encode(out, dc.Image(), &jpeg.Options{Quality: jpeg.DefaultQuality})
 	return
 }
 
-func printCameras(cam interface{}) {
-	switch c := cam.(type) {
-	case *GphotoCamera:
-		infoLog.Printf("Camera %s \n\t%t\n\t%s\n\t%s\n\t%s\n-------\n", c.FilenamePrefix, c.Enable, c.Interval, c.OutputDir, c.USBPort)
-	case *RaspberryPiCamera:
-		infoLog.Printf("Camera %s \n\t%t\n\t%s\n\t%s\n-------\n", c.FilenamePrefix, c.Enable, c.Interval, c.OutputDir)
-	default:
-		infoLog.Println("Idk")
-	}
+func printCameras(cam Camera) {
+	infoLog.Printf("%s\n-------\n", cam.Describe())
 }
 
-func reloadCameraConfig() {
+// loadConfig reads the configuration file at path and creates the cameras of every registered backend.
+// Errors in the TOML are returned together as configProblems, along with the cameras that could be loaded so
+// that validateConfig can find the remaining problems.
+func loadConfig(path string) (*GlobalConfig, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	config = &GlobalConfig{
-		"2006_01_02_15_04_05",
-		&RaspberryPiCamera{
-			Enable:         true,
-			Interval:       duration{time.Duration(time.Minute * 5)},
-			FilenamePrefix: "",
-			OutputDir:      "",
-		},
-		make(map[string]*GphotoCamera),
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := toml.DecodeFile(CONFIGPATH, &config); err != nil {
-		panic(err)
+	var problems configProblems
+	c := &GlobalConfig{
+		TimestampFormat: "2006_01_02_15_04_05",
+		ShutdownGrace:   duration{time.Duration(time.Second * 30)},
+		SysfsRoot:       "/sys",
+		Cameras:         make(map[string]Camera),
+	}
+	// decode the camera sections first, deferring them until we know which backend they belong to,
+	// this only fails if the file isn't valid toml at all
+	var sections map[string]toml.Primitive
+	md, err := toml.Decode(string(data), &sections)
+	if err != nil {
+		return nil, configProblems{err.Error()}
+	}
+	globalMd, err := toml.Decode(string(data), c)
+	if err != nil {
+		problems.add("%s", err)
 	}
 
-	if config.RpiCamera.FilenamePrefix == "" {
-		config.RpiCamera.FilenamePrefix = hostname + "-" + "Picam"
+	// the settings every camera was loaded from, to find changed cameras on reload
+	var global map[string]interface{}
+	if _, err := toml.Decode(string(data), &global); err != nil {
+		return nil, configProblems{err.Error()}
 	}
-	if config.RpiCamera.OutputDir == "" {
-		config.RpiCamera.OutputDir = filepath.Join("/var/lib/eyepi/", config.RpiCamera.FilenamePrefix)
+	tablesOf := func(section string) map[string]interface{} {
+		tables, _ := global[section].(map[string]interface{})
+		return tables
 	}
-	if config.RpiCamera.Interval.Duration <= time.Duration(time.Second) {
-		config.RpiCamera.Interval.Duration = time.Duration(time.Minute * 10)
+	inherited := make(map[string]interface{})
+	for key, value := range global {
+		if _, isBackend := cameraBackends[key]; !isBackend {
+			inherited[key] = value
+		}
+	}
+
+	// tables that failed to decode, their remaining keys aren't reported as unknown
+	failed := make(map[string]bool)
+	// decodeCamera creates a camera from its table, which is nil for single backends without a section
+	decodeCamera := func(backend cameraBackend, table *toml.Primitive, key, name string, loaded map[string]interface{}) Camera {
+		cam := backend.newCamera()
+		if table != nil {
+			if err := md.PrimitiveDecode(*table, cam); err != nil {
+				problems.add("[%s]: %s", key, err)
+				failed[key] = true
+				return nil
+			}
+		}
+		cam.Config().fillDefaults(hostname, name)
+		cam.Config().Calendar.inherit(&c.Calendar)
+		cam.Config().timestampFormat = c.TimestampFormat
+		cam.Config().sysfsRoot = c.SysfsRoot
+		cam.Config().loadedFrom = []map[string]interface{}{inherited, loaded}
+		return cam
 	}
-	os.MkdirAll(config.RpiCamera.OutputDir, 0777)
 
-	for name, cam := range config.Gphoto {
-		//fmt.Println(name, cam.FilenamePrefix)
-		if cam.FilenamePrefix == "" {
-			config.Gphoto[name].FilenamePrefix = hostname + "-" + name
+	for section, backend := range cameraBackends {
+		primitive, defined := sections[section]
+		if backend.single {
+			table := &primitive
+			if !defined {
+				table = nil
+			}
+			if cam := decodeCamera(backend, table, section, backend.label, tablesOf(section)); cam != nil {
+				c.Cameras[section] = cam
+			}
+			continue
+		}
+		if !defined {
+			continue
 		}
-		if cam.OutputDir == "" {
-			config.Gphoto[name].OutputDir = filepath.Join("/var/lib/eyepi/", config.Gphoto[name].FilenamePrefix)
+		var tables map[string]toml.Primitive
+		if err := md.PrimitiveDecode(primitive, &tables); err != nil {
+			problems.add("[%s]: %s", section, err)
+			continue
+		}
+		for name, table := range tables {
+			table := table
+			if _, exists := c.Cameras[name]; exists {
+				problems.add("[%s.%s]: there is already a camera called %s", section, name, name)
+				continue
+			}
+			loaded, _ := tablesOf(section)[name].(map[string]interface{})
+			if cam := decodeCamera(backend, &table, section+"."+name, name, loaded); cam != nil {
+				c.Cameras[name] = cam
+			}
 		}
-		if cam.Interval.Duration <= time.Duration(time.Second) {
-			config.Gphoto[name].Interval.Duration = time.Duration(time.Minute * 10)
+	}
+
+	problems = append(problems, linkGroups(c)...)
+
+	for _, key := range globalMd.Undecoded() {
+		if _, isBackend := cameraBackends[key[0]]; !isBackend {
+			problems.add("unknown key %s", key)
 		}
-		port, err := cam.resetUsb()
-		if err != nil {
-			cam.Enable = false
+	}
+	for _, key := range md.Undecoded() {
+		if _, isBackend := cameraBackends[key[0]]; isBackend && !failed[key[0]] && (len(key) < 2 || !failed[key[0]+"."+key[1]]) {
+			problems.add("unknown key %s", key)
 		}
-		config.Gphoto[name].USBPort = port
-		os.MkdirAll(cam.OutputDir, 0777)
 	}
 
-	printCameras(config.RpiCamera)
-	for _, cam := range config.Gphoto {
-		printCameras(cam)
+	if len(problems) > 0 {
+		return c, problems
 	}
+	return c, nil
+}
+
+// reloadCameraConfig reads and validates the configuration file, restarting the cameras whose settings changed.
+// A configuration with problems is rejected and the cameras keep running with the last good one.
+func reloadCameraConfig(runner *cameraRunner) error {
+	c, err := loadConfig(CONFIGPATH)
+	if err == nil {
+		err = validateConfig(c)
+	}
+	if err != nil {
+		return err
+	}
+	runner.apply(c)
+	config = c
+	return nil
 }
 
 func initLogging(
@@ -194,26 +285,61 @@ func init() {
 	errLogger, _ := syslog.New(syslog.LOG_NOTICE, "eyepi")
 	initLogging(infoLogger, warningLogger, errLogger)
 	infoLog.Printf("\n\tgo-eyepi v%s\n\tbuilt on %s", Version, Built)
-	mutex = &sync.Mutex{}
-	reloadCameraConfig()
+	usbLocks = newUsbLockManager(USBLOCKPATH)
 }
 
 func main() {
 	//defer profile.Start(profile.MemProfile).Stop()
 
+	checkConfig := flag.String("check-config", "", "check the configuration file at `path`, print every problem and exit")
+	flag.Usage = func() {
+		commandUsage()
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *checkConfig != "" {
+		problems := checkConfigFile(*checkConfig)
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", *checkConfig)
+		return
+	}
+
+	if flag.NArg() > 0 {
+		// the operator is watching, log to the terminal instead of syslog
+		initLogging(os.Stderr, os.Stderr, os.Stderr)
+		if err := runCommand(flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	telegrafClient, telegrafClientErr := telegraf.NewUnix("/tmp/telegraf.sock")
 	if telegrafClientErr != nil {
 		errLog.Println("Cannot create telegraf client QWTF!!!?: ", telegrafClientErr)
 	}
 
-	stopChan := make(chan bool)
-	timingChan := make(chan telegraf.Measurement)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	for _, cam := range config.Gphoto {
-		go cam.RunWait(stopChan, timingChan)
-	}
+	// cancelling captureCtx kills every capture in progress, it is only done on shutdown
+	captureCtx, killCaptures := context.WithCancel(context.Background())
+	defer killCaptures()
 
-	go config.RpiCamera.RunWait(stopChan, timingChan)
+	runner := newCameraRunner(captureCtx, func(measurement telegraf.Measurement) {
+		if telegrafClientErr == nil {
+			telegrafClient.Write(measurement)
+		}
+	})
+	if err := reloadCameraConfig(runner); err != nil {
+		errLog.Fatalf("invalid configuration %s:\n%s", CONFIGPATH, err)
+	}
 
 	usbChan := make(chan bool, 1)
 
@@ -228,48 +354,30 @@ func main() {
 
 	for {
 		select {
-		case measurement := <-timingChan:
-			if telegrafClientErr == nil {
-				telegrafClient.Write(measurement)
-			}
+		case measurement := <-runner.timingChan:
+			runner.write(measurement)
 		case <-usbChan:
-			for range config.Gphoto {
-				stopChan <- true
-			}
-			reloadCameraConfig()
-			for len(stopChan) > 0 {
-				<-stopChan
-			}
-			for len(timingChan) > 0 {
-				<-timingChan
+			// cameras that weren't connected are started if they are now, running ones find their port at every capture
+			if err := reloadCameraConfig(runner); err != nil {
+				errLog.Printf("invalid configuration %s, keeping the last good one:\n%s", CONFIGPATH, err)
 			}
 			for len(usbChan) > 0 {
 				<-usbChan
 			}
-			for _, cam := range config.Gphoto {
-				go cam.RunWait(stopChan, timingChan)
-			}
 		case event := <-watcher.Events:
 			if event.Op&fsnotify.Write == fsnotify.Write {
-				for range config.Gphoto {
-					stopChan <- true
-				}
-				stopChan <- true
-				reloadCameraConfig()
-				for len(stopChan) > 0 {
-					<-stopChan
-				}
-				for len(timingChan) > 0 {
-					<-timingChan
+				if err := reloadCameraConfig(runner); err != nil {
+					errLog.Printf("invalid configuration %s, keeping the last good one:\n%s", CONFIGPATH, err)
 				}
-				for len(usbChan) > 0 {
-					<-usbChan
-				}
-				for _, cam := range config.Gphoto {
-					go cam.RunWait(stopChan, timingChan)
-				}
-				go config.RpiCamera.RunWait(stopChan, timingChan)
 			}
+		case sig := <-signals:
+			infoLog.Printf("received %s, waiting up to %s for captures to finish\n", sig, config.ShutdownGrace)
+			if !runner.stopAll(config.ShutdownGrace.Duration) {
+				warnLog.Println("captures still running, killing them")
+				killCaptures()
+				runner.stopAll(time.Second * 5)
+			}
+			return
 		}
 	}
 
@@ -1,10 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/mdaffin/go-telegraf"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var /* const */ testFiles = []string{
@@ -153,6 +168,44 @@ func TestRegexes(t *testing.T) {
 	}
 }
 
+func TestParseGphotoError(t *testing.T) {
+	for _, data := range []struct {
+		stderr    string
+		expected  gphotoErrorKind
+		code      int
+		transient bool
+	}{
+		{`*** Error ***
+		An error occurred in the io-library ('I/O problem'): No error description available
+		*** Error (-7: 'I/O problem') ***`, ioProblem, -7, true},
+		// the failing --auto-detect output mentions a port, it must be taken as an error before looking for ports
+		{`*** Error (-7: 'I/O problem') ***
+		env LANG=C gphoto2 --debug --debug-logfile=my-logfile.txt --auto-detect --port=usb:001,006`, ioProblem, -7, true},
+		{`*** Error ***
+		An error occurred in the io-library ('Could not claim the USB device'): Could not claim interface 0 (Device or resource busy).
+		*** Error (-53: 'Could not claim the USB device') ***`, ioProblem, -53, true},
+		{`*** Error (-110: 'I/O in progress') ***
+		ERROR: Could not capture image.
+		ERROR: Could not capture.`, cameraBusy, -110, true},
+		{`*** Error: No camera found. ***`, modelNotFound, -105, false},
+		{`*** Error (-105: 'Unknown model') ***`, modelNotFound, -105, false},
+		{`*** Error (-115: 'Not enough free space') ***`, outOfSpace, -115, false},
+		{`*** Error (-1: 'Unspecified error') ***`, otherError, -1, true},
+	} {
+		e, ok := parseGphotoError(data.stderr)
+		if !ok || e.kind() != data.expected || e.Code != data.code || isTransient(e) != data.transient {
+			t.Errorf("%s: expected %s (%d, transient %t), actual %v", data.stderr, data.expected, data.code, data.transient, e)
+		}
+	}
+	if _, ok := parseGphotoError("New file is in location /capt0000.jpg on the camera"); ok {
+		t.Error("expected no error in normal output")
+	}
+	err := gphotoCommandError(errors.New("exit status 1"), "something unexpected")
+	if _, isGphotoError := err.(gphotoError); isGphotoError || !strings.Contains(err.Error(), "something unexpected") {
+		t.Errorf("expected the stderr of an unknown error, actual %v", err)
+	}
+}
+
 var udevTestExpected = map[string]string{
 	"MAJOR":   "189",
 	"MINOR":   "258",
@@ -165,7 +218,7 @@ var udevTestExpected = map[string]string{
 	"DEVNUM":  "003",
 }
 
-func TestgetEventFromUEventFile(t *testing.T) {
+func TestGetEventFromUEventFile(t *testing.T) {
 	stuff, err := getEventFromUEventFile("test-data/uevent")
 	if err != nil {
 		t.Error(err)
@@ -174,3 +227,1965 @@ func TestgetEventFromUEventFile(t *testing.T) {
 		t.Errorf("uevent unexpected. %s", stuff)
 	}
 }
+
+func TestLoadConfig(t *testing.T) {
+	c, err := loadConfig("go-eyepi.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Cameras) != 3 {
+		t.Errorf("expected 3 cameras, got %d", len(c.Cameras))
+	}
+	picam, ok := c.Cameras["rpicamera"].(*RaspberryPiCamera)
+	if !ok {
+		t.Fatalf("rpicamera is %T", c.Cameras["rpicamera"])
+	}
+	if picam.FilenamePrefix != "Test" || picam.Interval.Duration != time.Second*30 {
+		t.Errorf("rpicamera unexpected. %s", picam.Describe())
+	}
+	gcam, ok := c.Cameras["camera1"].(*GphotoCamera)
+	if !ok {
+		t.Fatalf("camera1 is %T", c.Cameras["camera1"])
+	}
+	if gcam.GphotoSerialNumber != "4fffa81fed8f40d286a63fce62598ef0" || gcam.OutputDir != "/home/go-eyepi" {
+		t.Errorf("camera1 unexpected. %s", gcam.Describe())
+	}
+}
+
+var nextTimepointData = []struct {
+	config        string
+	now, expected string
+}{
+	{`interval = "10m"`, "2018-06-01T10:03:12Z", "2018-06-01T10:10:00Z"},
+	{`interval = "1h"`, "2018-06-01T10:00:00Z", "2018-06-01T11:00:00Z"},
+	{`schedule = ["0 */15 6-19 * * MON-FRI", "0 0 20-23,0-5 * * *"]`, "2018-06-01T10:03:12Z", "2018-06-01T10:15:00Z"},
+	{`schedule = ["0 */15 6-19 * * MON-FRI", "0 0 20-23,0-5 * * *"]`, "2018-06-01T19:50:00Z", "2018-06-01T20:00:00Z"},
+	// 2018-06-02 is a saturday
+	{`schedule = ["0 */15 6-19 * * MON-FRI", "0 0 20-23,0-5 * * *"]`, "2018-06-02T10:03:12Z", "2018-06-02T20:00:00Z"},
+	{`schedule = ["30 * * * * *"]`, "2018-06-01T10:03:12Z", "2018-06-01T10:03:30Z"},
+}
+
+func TestNextTimepoint(t *testing.T) {
+	for _, data := range nextTimepointData {
+		var c CameraConfig
+		if _, err := toml.Decode(data.config, &c); err != nil {
+			t.Fatal(err)
+		}
+		now, _ := time.Parse(time.RFC3339, data.now)
+		expected, _ := time.Parse(time.RFC3339, data.expected)
+		if next := c.nextTimepoint(now); !next.Equal(expected) {
+			t.Errorf("%s at %s: expected %s, actual %s", data.config, data.now, expected, next)
+		}
+	}
+}
+
+var sunriseSunsetData = []struct {
+	latitude, longitude float64
+	date                time.Time
+	sunrise, sunset     string
+}{
+	// Canberra, winter solstice
+	{-35.28, 149.13, time.Date(2018, 6, 21, 12, 0, 0, 0, time.FixedZone("AEST", 10*3600)), "07:12", "16:58"},
+	// London, summer solstice
+	{51.51, -0.13, time.Date(2018, 6, 21, 12, 0, 0, 0, time.FixedZone("BST", 3600)), "04:43", "21:21"},
+	// Quito, equinox
+	{-0.18, -78.47, time.Date(2018, 3, 20, 12, 0, 0, 0, time.FixedZone("ECT", -5*3600)), "06:17", "18:24"},
+}
+
+func TestSunriseSunset(t *testing.T) {
+	for _, data := range sunriseSunsetData {
+		sunrise, sunset := sunriseSunset(data.date, data.latitude, data.longitude)
+		for _, event := range []struct {
+			actual   time.Time
+			expected string
+		}{{sunrise, data.sunrise}, {sunset, data.sunset}} {
+			expected, _ := time.ParseInLocation("2006-01-02 15:04", data.date.Format("2006-01-02 ")+event.expected, data.date.Location())
+			if diff := event.actual.Sub(expected); diff > 2*time.Minute || diff < -2*time.Minute {
+				t.Errorf("%.2f,%.2f: expected %s, actual %s", data.latitude, data.longitude, expected, event.actual)
+			}
+		}
+	}
+
+	// midnight sun in Tromsø
+	date := time.Date(2018, 6, 21, 12, 0, 0, 0, time.UTC)
+	if sunrise, sunset := sunriseSunset(date, 69.65, 18.96); sunset.Sub(sunrise) != 24*time.Hour {
+		t.Errorf("expected midnight sun, got %s to %s", sunrise, sunset)
+	}
+}
+
+func TestCaptureWindow(t *testing.T) {
+	var c CameraConfig
+	_, err := toml.Decode(`
+	latitude = -35.28
+	longitude = 149.13
+	capturefrom = "sunrise-30m"
+	captureuntil = "sunset+1h"`, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2018, 6, 21, 12, 0, 0, 0, time.FixedZone("AEST", 10*3600))
+	sunrise, sunset := sunriseSunset(date, c.Latitude, c.Longitude)
+	from, until := c.captureWindow(date)
+	if !from.Equal(sunrise.Add(-30*time.Minute)) || !until.Equal(sunset.Add(time.Hour)) {
+		t.Errorf("unexpected capture window %s to %s", from, until)
+	}
+
+	var bad solarTime
+	for _, spec := range []string{"noon", "sunrise30m", "sunset+x"} {
+		if err := bad.UnmarshalText([]byte(spec)); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	var global, camera Calendar
+	if _, err := toml.Decode(`
+	startdate = "2018-06-01"
+	enddate = "2018-08-31"
+	blackouts = [{from = "2018-07-01 08:00", until = "2018-07-01 17:00", reason = "cleaning"}]`, &global); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := toml.Decode(`
+	enddate = "2018-07-31 12:00"
+	[[blackouts]]
+	from = "2018-07-10"
+	until = "2018-07-11"`, &camera); err != nil {
+		t.Fatal(err)
+	}
+	camera.inherit(&global)
+
+	for _, data := range []struct {
+		calendar *Calendar
+		at       string
+		active   bool
+	}{
+		{&global, "2018-05-31 23:59", false},
+		{&global, "2018-06-01 00:00", true},
+		{&global, "2018-07-01 12:00", false},
+		{&global, "2018-07-01 17:00", true},
+		{&global, "2018-08-31 23:59", true},
+		{&global, "2018-09-01 00:00", false},
+		{&camera, "2018-06-01 00:00", true},
+		{&camera, "2018-07-01 12:00", false},
+		{&camera, "2018-07-11 23:00", false},
+		{&camera, "2018-07-12 00:00", true},
+		{&camera, "2018-07-31 12:00", false},
+	} {
+		at, _ := time.ParseInLocation("2006-01-02 15:04", data.at, time.Local)
+		if active, reason := data.calendar.state(at); active != data.active {
+			t.Errorf("%s: expected active %t, actual %t (%s)", data.at, data.active, active, reason)
+		}
+	}
+}
+
+func TestBracketCommand(t *testing.T) {
+	cam := &GphotoCamera{USBPort: "usb:001,006", BracketConfig: "exposurecompensation"}
+	cam.FilenamePrefix = "cam"
+	if name := cam.frameName("2018_06_01_10_00_00", 0, 1); name != "cam_2018_06_01_10_00_00" {
+		t.Errorf("unexpected single frame name %s", name)
+	}
+	name := cam.frameName("2018_06_01_10_00_00", 2, 3)
+	if name != "cam_2018_06_01_10_00_00_02" {
+		t.Errorf("unexpected frame name %s", name)
+	}
+	command := cam.createCaptureCommand(context.Background(), name+".%C", "exposurecompensation=-2")
+	expected := []string{"gphoto2", "--port", "usb:001,006", "--set-config=capturetarget=0",
+		"--set-config=exposurecompensation=-2", "--force-overwrite", "--capture-image-and-download",
+		"--filename=cam_2018_06_01_10_00_00_02.%C"}
+	if !reflect.DeepEqual(command.Args, expected) {
+		t.Errorf("expected %s, actual %s", expected, command.Args)
+	}
+}
+
+func TestOverrun(t *testing.T) {
+	timepoint := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	result := captureResult{
+		Timepoint: timepoint,
+		Start:     timepoint.Add(time.Second),
+		Finish:    timepoint.Add(3*time.Minute + 30*time.Second),
+	}
+	for _, data := range []struct {
+		policy  overrunPolicy
+		pending time.Time
+		skipped int
+	}{
+		{overrunSkip, time.Time{}, 3},
+		{overrunQueue, timepoint.Add(time.Minute), 2},
+		{overrunImmediate, timepoint.Add(3 * time.Minute), 2},
+	} {
+		c := CameraConfig{Interval: duration{time.Minute}, OverrunPolicy: data.policy}
+		pending, skipped := c.overrun(result)
+		if !pending.Equal(data.pending) || skipped != data.skipped {
+			t.Errorf("%s: expected %s and %d skipped, actual %s and %d skipped", data.policy, data.pending, data.skipped, pending, skipped)
+		}
+	}
+
+	c := CameraConfig{Interval: duration{time.Hour}, OverrunPolicy: overrunQueue}
+	if pending, skipped := c.overrun(result); !pending.IsZero() || skipped != 0 {
+		t.Errorf("expected no overrun, actual %s and %d skipped", pending, skipped)
+	}
+}
+
+// fakeCamera returns errs from its captures in order, then succeeds
+type fakeCamera struct {
+	CameraConfig
+	errs     []error
+	captures int
+	// delay is how long the camera takes to get ready to trigger
+	delay time.Duration
+}
+
+func (cam *fakeCamera) capture(ctx context.Context, timestamp string) error {
+	return cam.captureFrames(ctx, timestamp, nil)
+}
+
+func (cam *fakeCamera) captureFrames(ctx context.Context, timestamp string, sync *syncPoint) error {
+	cam.captures++
+	if cam.captures <= len(cam.errs) {
+		return cam.errs[cam.captures-1]
+	}
+	time.Sleep(cam.delay)
+	if err := sync.wait(ctx); err != nil {
+		return err
+	}
+	sync.shutter()
+	return nil
+}
+
+func (cam *fakeCamera) Describe() string { return cam.describe() }
+
+func (cam *fakeCamera) Health(ctx context.Context) error { return nil }
+
+func TestCaptureWithRetries(t *testing.T) {
+	transient := errors.New("I/O problem")
+	notFound := permanentError{errors.New("not detected")}
+	for _, data := range []struct {
+		errs             []error
+		retries          int
+		expectedCaptures int
+		expectedErr      error
+	}{
+		{nil, 2, 1, nil},
+		{[]error{transient, transient}, 2, 3, nil},
+		{[]error{transient, transient, transient}, 2, 3, transient},
+		{[]error{notFound}, 2, 1, notFound},
+		{[]error{transient}, 0, 1, transient},
+	} {
+		cam := &fakeCamera{errs: data.errs}
+		cam.Retries = data.retries
+		cam.RetryBackoff.Duration = time.Millisecond
+		retries, stopped, err := captureWithRetries(context.Background(), context.Background(), cam, "")
+		if err != data.expectedErr || stopped || cam.captures != data.expectedCaptures || retries != cam.captures-1 {
+			t.Errorf("%v: expected %d captures and %v, actual %d captures, %d retries and %v",
+				data.errs, data.expectedCaptures, data.expectedErr, cam.captures, retries, err)
+		}
+	}
+}
+
+func TestSameSettings(t *testing.T) {
+	original, err := ioutil.ReadFile("go-eyepi.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Replace(original, []byte(`interval = "1h"`), []byte(`interval = "2h"`), 1)
+	path := filepath.Join(os.TempDir(), "go-eyepi-test.conf")
+	defer os.Remove(path)
+	if err := ioutil.WriteFile(path, changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := loadConfig("go-eyepi.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"rpicamera": true, "camera1": true, "camera2": false} {
+		if same := sameSettings(a.Cameras[name], b.Cameras[name]); same != expected {
+			t.Errorf("%s: expected same settings %t, actual %t", name, expected, same)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "eyepi.conf")
+
+	testCases := []struct {
+		conf     string
+		problems []string
+	}{
+		{`
+[gphoto.camera1]
+gphotoserialnumber = "4fffa81fed8f40d286a63fce62598ef0"
+outputdir = "` + dir + `"
+`, nil},
+		{`
+[gphoto.camera1
+`, []string{"table name"}},
+		{`
+shutdowngrace = "soon"
+timestampfromat = "2006-01-02"
+[gphoto.camera1]
+interval = "10 minutes"
+gphotoserialnumber = "4fffa81fed8f40d286a63fce62598ef0"
+outputdir = "` + dir + `"
+`, []string{"soon", "10 minutes", "timestampfromat"}},
+		{`
+[gphoto.camera1]
+filenameprefix = "cam"
+gphotoserialnumber = "4fffa81fed8f40d286a63fce62598ef0"
+outputdir = "` + dir + `"
+retries = -1
+[gphoto.camera2]
+filenameprefix = "cam"
+gphotoserialnumber = "4fffa81fed8f40d286a63fce62598ef0"
+outputdir = "` + dir + `"
+capturefrom = "sunrise"
+[gphoto.camera3]
+outputdir = "` + dir + `"
+[gphoto.camera4]
+outputdir = "` + dir + `"
+usbid = "canon"
+match = ["usbpath", "usbid"]
+`, []string{
+			"camera1: retries",
+			"camera2: capturefrom",
+			"camera2: filenameprefix cam is also used by camera1",
+			`camera2: gphoto2 camera with gphotoserialnumber = "4fffa81fed8f40d286a63fce62598ef0" is also used by camera1`,
+			"camera3: one of gphotoserialnumber, usbpath, usbid or model is required",
+			"camera4: match has usbpath, but it isn't set",
+			`camera4: usbid "canon" isn't a vendor:product id`,
+		}},
+		{`
+[gphoto.camera1]
+gphotoserialnumber = "4fffa81fed8f40d286a63fce62598ef0"
+outputdir = "` + dir + `"
+[group.bench]
+cameras = ["camera1", "camera2"]
+outputdir = "` + dir + `"
+[group.shelf]
+cameras = ["camera1", "bench"]
+outputdir = "` + dir + `"
+`, []string{
+			"bench: there is no camera called camera2",
+			"shelf: camera1 is already a member of bench",
+			"shelf: bench can't be a member of a group",
+		}},
+	}
+	for i, tc := range testCases {
+		if err := ioutil.WriteFile(path, []byte(tc.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		problems := checkConfigFile(path)
+		if len(problems) < len(tc.problems) || len(tc.problems) == 0 && len(problems) > 0 {
+			t.Errorf("%d: expected %d problems, actual %q", i, len(tc.problems), problems)
+			continue
+		}
+		for _, expected := range tc.problems {
+			if !strings.Contains(problems.Error(), expected) {
+				t.Errorf("%d: expected a problem with %q, actual %q", i, expected, problems)
+			}
+		}
+	}
+}
+
+func TestRecordStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &CameraConfig{OutputDir: dir}
+	if _, err := c.readStatus(); !os.IsNotExist(err) {
+		t.Errorf("expected no status before the first capture, actual %v", err)
+	}
+	timepoint := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	result := captureResult{
+		Timepoint: timepoint,
+		Start:     timepoint.Add(time.Second),
+		Finish:    timepoint.Add(time.Second * 5),
+		Retries:   2,
+		Err:       errors.New("I/O error"),
+	}
+	if err := c.recordStatus(result); err != nil {
+		t.Fatal(err)
+	}
+	status, err := c.readStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Timepoint.Equal(result.Timepoint) || !status.Finish.Equal(result.Finish) ||
+		status.Retries != 2 || status.Error != "I/O error" {
+		t.Errorf("expected status of %+v, actual %+v", result, status)
+	}
+}
+
+func TestUsbLock(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "go-eyepi-test.lock")
+	defer os.Remove(path)
+	defer os.Remove(filepath.Join(os.TempDir(), "go-eyepi-test-001.lock"))
+	defer os.Remove(filepath.Join(os.TempDir(), "go-eyepi-test-002.lock"))
+
+	// separate managers on the same files stand in for separate processes
+	daemon, operator := newUsbLockManager(path), newUsbLockManager(path)
+	locked := func(lock func() func()) bool {
+		result := make(chan func())
+		go func() {
+			result <- lock()
+		}()
+		select {
+		case unlock := <-result:
+			unlock()
+			return true
+		case <-time.After(time.Millisecond * 100):
+			// unlock once it is locked after all
+			go func() { (<-result)() }()
+			return false
+		}
+	}
+	bus := func(l *usbLockManager, port string) func() func() {
+		return func() func() {
+			unlock, _ := l.lockBuses(port)
+			return unlock
+		}
+	}
+
+	unlock, _ := daemon.lockBuses("usb:001,006")
+	if locked(bus(operator, "usb:001,007")) {
+		t.Error("locked a bus while another process holds it")
+	}
+	if !locked(bus(operator, "usb:002,003")) {
+		t.Error("not locked a free bus while another one is held")
+	}
+	if locked(operator.lockAll) {
+		t.Error("locked every bus while another process holds one")
+	}
+	unlock()
+	time.Sleep(time.Millisecond * 100)
+	if !locked(operator.lockAll) {
+		t.Error("not locked every bus after the other process released its bus")
+	}
+}
+
+func TestGroupCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the slow camera takes longer to get ready than the spread allows, the others wait for it at the barrier
+	fast := &fakeCamera{}
+	slow := &fakeCamera{delay: time.Millisecond * 100}
+	failing := &fakeCamera{errs: []error{errors.New("I/O problem")}}
+	g := &CameraGroup{name: "bench"}
+	for i, cam := range []*fakeCamera{fast, slow, failing} {
+		cam.Enable = true
+		cam.FilenamePrefix = fmt.Sprintf("cam%d", i)
+		cam.OutputDir = dir
+		g.members = append(g.members, cam)
+	}
+
+	if err := g.capture(context.Background(), "2018_06_01_12_00_00"); err == nil || !strings.Contains(err.Error(), "cam2") {
+		t.Errorf("expected cam2 to fail, actual %v", err)
+	}
+	if g.spread > time.Millisecond*50 {
+		t.Errorf("expected the members to trigger together, actual spread %s", g.spread)
+	}
+	// the retry only repeats the member that failed
+	if err := g.capture(context.Background(), "2018_06_01_12_00_00"); err != nil {
+		t.Errorf("expected the retry to succeed, actual %v", err)
+	}
+	if fast.captures != 1 || slow.captures != 1 || failing.captures != 2 {
+		t.Errorf("expected 1, 1 and 2 captures, actual %d, %d and %d", fast.captures, slow.captures, failing.captures)
+	}
+	// a member that timed out counts for the group, RunWait only takes the timeouts of the group
+	slow.timeouts = 1
+	if err := g.capture(context.Background(), "2018_06_01_12_10_00"); err != nil || fast.captures != 2 {
+		t.Errorf("expected every member to capture the next timepoint, actual %v and %d captures", err, fast.captures)
+	}
+	if timeouts := g.takeTimeouts(); timeouts != 1 {
+		t.Errorf("expected the timeout of the slow member, actual %d", timeouts)
+	}
+}
+
+func TestCaptureTimeout(t *testing.T) {
+	c := &CameraConfig{FilenamePrefix: "test", CaptureTimeout: duration{time.Millisecond * 100}}
+	for _, data := range []struct {
+		script   string
+		timedOut bool
+	}{
+		{"true", false},
+		// the background sleep keeps stdout open, waiting only ends early if the whole process group is killed
+		{"sleep 10 & sleep 10", true},
+	} {
+		cmd := exec.Command("sh", "-c", data.script)
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		if err := startProcess(cmd); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err := c.waitProcess(context.Background(), cmd)
+		if _, timedOut := err.(captureTimeoutError); timedOut != data.timedOut || time.Since(start) > time.Second*5 {
+			t.Errorf("%s: expected timeout %t, actual %v after %s", data.script, data.timedOut, err, time.Since(start))
+		}
+	}
+	if timeouts := c.takeTimeouts(); timeouts != 1 {
+		t.Errorf("expected 1 timeout, actual %d", timeouts)
+	}
+}
+
+// gphotoConfigData is captured gphoto2 output of several cameras
+var gphotoConfigData = []struct {
+	camera, output string
+	expected       []GphotoWidget
+	err            bool
+}{
+	{"Canon EOS 650D --get-config serialnumber --get-config iso",
+		`Label: Serial Number
+		Readonly: 0
+		Type: TEXT
+		Current: cd6acfa090894f9bbe7b21037a49389b
+		END
+		Label: ISO Speed
+		Readonly: 0
+		Type: RADIO
+		Current: 200
+		Choice: 0 Auto
+		Choice: 1 100
+		Choice: 2 200
+		END
+		`, []GphotoWidget{
+			{Label: "Serial Number", Type: "TEXT", Current: "cd6acfa090894f9bbe7b21037a49389b"},
+			{Label: "ISO Speed", Type: "RADIO", Current: "200", Choices: []string{"Auto", "100", "200"}},
+		}, false},
+	{"Canon EOS 650D --list-all-config",
+		`/main/actions/syncdatetime
+Label: Set camera date and time to PC time
+Readonly: 0
+Type: TOGGLE
+Current: 2
+END
+/main/settings/datetime
+Label: Camera Date and Time
+Readonly: 0
+Type: DATE
+Current: 1528345560
+Printable: Thu 07 Jun 2018 02:26:00 PM AEST
+Help: Use 'now' as the current time when setting.
+
+END
+/main/status/batterylevel
+Label: Battery Level
+Readonly: 1
+Type: TEXT
+Current: 75%
+END
+/main/capturesettings/shutterspeed
+Label: Shutter Speed
+Readonly: 0
+Type: RADIO
+Current: 1/125
+Choice: 0 bulb
+Choice: 1 30
+Choice: 2 1/125
+END
+`, []GphotoWidget{
+			{Path: "/main/actions/syncdatetime", Label: "Set camera date and time to PC time", Type: "TOGGLE", Current: "2"},
+			{Path: "/main/settings/datetime", Label: "Camera Date and Time", Type: "DATE", Current: "1528345560",
+				Printable: "Thu 07 Jun 2018 02:26:00 PM AEST"},
+			{Path: "/main/status/batterylevel", Label: "Battery Level", Type: "TEXT", Readonly: true, Current: "75%"},
+			{Path: "/main/capturesettings/shutterspeed", Label: "Shutter Speed", Type: "RADIO", Current: "1/125",
+				Choices: []string{"bulb", "30", "1/125"}},
+		}, false},
+	{"Nikon D5300 --list-all-config",
+		`/main/capturesettings/exposurecompensation
+Label: Exposure Compensation
+Readonly: 0
+Type: MENU
+Current: 0
+Choice: 0 -5
+Choice: 1 0
+Choice: 2 5
+END
+/main/capturesettings/flashexposurecompensation
+Label: Flash Exposure Compensation
+Readonly: 0
+Type: RANGE
+Current: 0
+Bottom: -3
+Top: 1
+Step: 0.333333
+END
+/main/other/d054
+Label: Artist
+Readonly: 0
+Type: TEXT
+Current:
+END
+`, []GphotoWidget{
+			{Path: "/main/capturesettings/exposurecompensation", Label: "Exposure Compensation", Type: "MENU", Current: "0",
+				Choices: []string{"-5", "0", "5"}},
+			{Path: "/main/capturesettings/flashexposurecompensation", Label: "Flash Exposure Compensation", Type: "RANGE",
+				Current: "0", Bottom: -3, Top: 1, Step: 0.333333},
+			{Path: "/main/other/d054", Label: "Artist", Type: "TEXT"},
+		}, false},
+	{"Sony A6000 --get-config iso failing",
+		`*** Error ***
+		An error occurred in the io-library ('I/O problem'): No error description available
+		*** Error (-7: 'I/O problem') ***
+		`, nil, false},
+	{"truncated output", `/main/imgsettings/iso
+Label: ISO Speed
+Type: RADIO
+Current: 100
+Choice: 0 Auto
+`, nil, true},
+	{"invalid range", `Label: Zoom
+Type: RANGE
+Bottom: wide
+END
+`, nil, true},
+}
+
+func TestParseGphotoConfig(t *testing.T) {
+	for _, data := range gphotoConfigData {
+		widgets, err := parseGphotoConfig(data.output)
+		if (err != nil) != data.err || !reflect.DeepEqual(widgets, data.expected) {
+			t.Errorf("%s: expected %+v (error %t), actual %+v and %v", data.camera, data.expected, data.err, widgets, err)
+		}
+	}
+}
+
+func TestGphotoWidgetAccepts(t *testing.T) {
+	radio := GphotoWidget{Type: "RADIO", Current: "100", Choices: []string{"Auto", "100", "200"}}
+	rangeWidget := GphotoWidget{Type: "RANGE", Current: "0", Bottom: -3, Top: 1, Step: 0.333333}
+	toggle := GphotoWidget{Type: "TOGGLE", Current: "1"}
+	for _, data := range []struct {
+		widget          GphotoWidget
+		value           string
+		accepts, equals bool
+	}{
+		{radio, "200", true, false},
+		{radio, "100", true, true},
+		{radio, "300", false, false},
+		{rangeWidget, "-2.5", true, false},
+		{rangeWidget, "0.0", true, true},
+		{rangeWidget, "2", false, false},
+		{toggle, "on", true, true},
+		{toggle, "maybe", false, false},
+		{GphotoWidget{Type: "TEXT", Readonly: true}, "x", false, false},
+		{GphotoWidget{Type: "TEXT", Current: "eyepi"}, "eyepi", true, true},
+	} {
+		if accepts := data.widget.accepts(data.value) == nil; accepts != data.accepts {
+			t.Errorf("%+v: expected %s accepted %t, actual %t", data.widget, data.value, data.accepts, accepts)
+		}
+		if equals := data.widget.holds(data.value); equals != data.equals {
+			t.Errorf("%+v: expected %s held %t, actual %t", data.widget, data.value, data.equals, equals)
+		}
+	}
+}
+
+// isoGphoto2 is a gphoto2 that keeps the iso that was set but ignores the whitebalance, see fakeGphoto2
+const isoGphoto2 = `state="$(dirname "$0")/iso"
+[ -f "$state" ] || echo Auto > "$state"
+for arg in "$@"; do
+	case "$arg" in
+	--set-config=iso=*) echo "${arg#--set-config=iso=}" > "$state";;
+	iso) printf 'Label: ISO Speed\nType: RADIO\nCurrent: %s\nChoice: 0 Auto\nChoice: 1 100\nChoice: 2 200\nEND\n' "$(cat "$state")";;
+	whitebalance) printf 'Label: WhiteBalance\nType: RADIO\nCurrent: Auto\nChoice: 0 Auto\nChoice: 1 Daylight\nEND\n';;
+	esac
+done
+`
+
+func TestApplySettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer fakeGphoto2(t, isoGphoto2)()
+
+	for _, data := range []struct {
+		settings map[string]string
+		expected string
+	}{
+		{map[string]string{"iso": "200"}, ""},
+		{map[string]string{"iso": "300"}, `does not accept iso = "300", the choices are ["Auto" "100" "200"]`},
+		{map[string]string{"iso": "100", "whitebalance": "Daylight"}, `did not take whitebalance = "Daylight" (the camera kept "Auto")`},
+	} {
+		cam := &GphotoCamera{Settings: data.settings, USBPort: "usb:001,006"}
+		cam.FilenamePrefix = "camera1"
+		err := cam.applySettings(context.Background())
+		if data.expected == "" && err != nil || data.expected != "" && (err == nil || !strings.Contains(err.Error(), data.expected)) {
+			t.Errorf("%v: expected %q, actual %v", data.settings, data.expected, err)
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	original, err := ioutil.ReadFile("go-eyepi.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cameras found by their model and usb id rather than a serial number
+	original = append(original, []byte(`
+[gphoto.nikon]
+model = "Nikon DSC D5300"
+[gphoto.studio]
+usbid = "04a9:3218"
+`)...)
+	path := filepath.Join(os.TempDir(), "go-eyepi-test.conf")
+	defer os.Remove(path)
+	if err := ioutil.WriteFile(path, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	detected := parseAutoDetect([]byte(`Model                          Port
+----------------------------------------------------------
+Canon EOS 650D                 usb:001,006
+Canon EOS 650D                 usb:001,007
+Nikon DSC D5300                usb:002,004
+Sony Alpha-A6000 (Control)     usb:002,005
+Canon EOS 650D                 usb:001,008
+Canon EOS 5D Mark III          usb:001,009
+`))
+	if len(detected) != 6 || detected[2].Model != "Nikon DSC D5300" || detected[2].Port != "usb:002,004" {
+		t.Fatalf("unexpected cameras detected: %+v", detected)
+	}
+	for i := range detected {
+		detected[i].serialRead = true
+	}
+	detected[0].SerialNumber = "4fffa81fed8f40d286a63fce62598ef0" // camera1
+	// two cameras with the same serial number are found by their usb path
+	detected[1].SerialNumber, detected[1].USBPath = "cd6acfa090894f9bbe7b21037a49389b", "1-1.2"
+	detected[4].SerialNumber, detected[4].USBPath = "cd6acfa090894f9bbe7b21037a49389b", "1-1.3"
+	detected[2].SerialNumber = "3a5b29f0c1d84e6f9b7a2e0d5c4f8a71" // nikon
+	detected[5].USBID = "04a9:3218"                               // studio
+
+	stanzas, skipped := newCameraStanzas(context.Background(), c, detected)
+	expectedSkipped := []string{
+		"Canon EOS 650D on usb:001,006 is already configured as camera1",
+		"Nikon DSC D5300 on usb:002,004 is already configured as nikon",
+		"Sony Alpha-A6000 (Control) on usb:002,005 has no unique serial number or usb path to find it by",
+		"Canon EOS 5D Mark III on usb:001,009 is already configured as studio",
+	}
+	if !reflect.DeepEqual(skipped, expectedSkipped) {
+		t.Errorf("expected %q to be skipped, actual %q", expectedSkipped, skipped)
+	}
+	if err := appendToConfig(path, stanzas); err != nil {
+		t.Fatal(err)
+	}
+	c, err = loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, usbPath := range map[string]string{"camera3": "1-1.2", "camera4": "1-1.3"} {
+		if cam, ok := c.Cameras[name].(*GphotoCamera); !ok || cam.USBPath != usbPath || cam.GphotoSerialNumber != "" ||
+			cam.Model != "Canon EOS 650D" {
+			t.Errorf("expected %s on usb path %s, actual %+v", name, usbPath, c.Cameras[name])
+		}
+	}
+	written, _ := ioutil.ReadFile(path)
+	if !bytes.HasPrefix(written, original) {
+		t.Error("the existing config was changed")
+	}
+
+	// discovering again adds nothing
+	if stanzas, _ := newCameraStanzas(context.Background(), c, detected); stanzas != "" {
+		t.Errorf("expected no new cameras, actual %s", stanzas)
+	}
+
+	// a new camera with a serial number of its own is found by it
+	detected = append(detected, detectedCamera{Model: "Canon EOS 650D", Port: "usb:001,010",
+		SerialNumber: "5e1d0c9b8a7f4e3d2c1b0a9f8e7d6c5b", serialRead: true})
+	if stanzas, _ := newCameraStanzas(context.Background(), c, detected); !strings.Contains(stanzas,
+		"[gphoto.camera5]\nenable = true\ninterval = \"10m\"\ngphotoserialnumber = \"5e1d0c9b8a7f4e3d2c1b0a9f8e7d6c5b\"\n") {
+		t.Errorf("expected camera5 found by its serial number, actual %s", stanzas)
+	}
+}
+
+// fakeSysfs creates a sysfs tree with the camera of test-data/uevent as 3-1.2 on port 2 of hub 3-1
+func fakeSysfs(t *testing.T, portPower bool) string {
+	root, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uevent, err := ioutil.ReadFile("test-data/uevent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"bus/usb/drivers/usb/bind":           "",
+		"bus/usb/drivers/usb/unbind":         "",
+		"bus/usb/devices/3-1/uevent":         "DEVTYPE=usb_device\nBUSNUM=003\nDEVNUM=002\n",
+		"bus/usb/devices/3-1.2/uevent":       string(uevent),
+		"bus/usb/devices/3-1.2/authorized":   "1",
+		"bus/usb/devices/3-1.2:1.0/uevent":   "DEVTYPE=usb_interface\n",
+		"bus/usb/devices/3-1/3-1:1.0/uevent": "DEVTYPE=usb_interface\n",
+	}
+	if portPower {
+		files["bus/usb/devices/3-1/3-1:1.0/3-1-port2/disable"] = "0"
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "bus/usb/drivers/usb"), filepath.Join(root, "bus/usb/devices/3-1.2/driver")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestRecoverUsbDevice(t *testing.T) {
+	tests := []struct {
+		port       string
+		portPower  bool
+		foundAfter int
+		// the attributes after recovery, and the number of steps tried
+		expected map[string]string
+		steps    int
+		err      string
+	}{
+		{"usb:003,003", true, 1, map[string]string{"authorized": "1", "unbind": ""}, 1, ""},
+		{"usb:003,003", true, 2, map[string]string{"unbind": "3-1.2", "bind": "3-1.2", "disable": "0"}, 2, ""},
+		{"usb:003,003", true, 0, map[string]string{"unbind": "3-1.2", "bind": "3-1.2", "disable": "0"}, 3, "power cycling didn't bring it back"},
+		{"usb:003,003", false, 0, map[string]string{"unbind": "3-1.2"}, 2, "doesn't switch port power"},
+		{"usb:003,009", true, 1, nil, 0, "no usb device for usb:003,009"},
+	}
+	for _, test := range tests {
+		root := fakeSysfs(t, test.portPower)
+		steps := 0
+		d, err := findSysfsDevice(root, test.port)
+		if err == nil {
+			err = recoverUsbDevice(context.Background(), d, test.port, 0, 0, func() bool {
+				steps++
+				return steps == test.foundAfter
+			})
+		}
+		if test.err == "" && err != nil {
+			t.Errorf("recovering %s (found after %d steps) failed: %s", test.port, test.foundAfter, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("recovering %s (found after %d steps) expected %q, got %v", test.port, test.foundAfter, test.err, err)
+		}
+		if steps != test.steps {
+			t.Errorf("recovering %s (found after %d steps) took %d steps, expected %d", test.port, test.foundAfter, steps, test.steps)
+		}
+		paths := map[string]string{
+			"authorized": "bus/usb/devices/3-1.2/authorized",
+			"bind":       "bus/usb/drivers/usb/bind",
+			"unbind":     "bus/usb/drivers/usb/unbind",
+			"disable":    "bus/usb/devices/3-1/3-1:1.0/3-1-port2/disable",
+		}
+		for attribute, expected := range test.expected {
+			content, err := ioutil.ReadFile(filepath.Join(root, paths[attribute]))
+			if err != nil || string(content) != expected {
+				t.Errorf("recovering %s (found after %d steps) left %s = %q (%v), expected %q",
+					test.port, test.foundAfter, attribute, content, err, expected)
+			}
+		}
+		os.RemoveAll(root)
+	}
+
+	roothub := sysfsDevice{root: "/sys", name: "3-1"}
+	if path := roothub.portPowerPath(); path != "/sys/bus/usb/devices/usb3/3-0:1.0/usb3-port1/disable" {
+		t.Errorf("port power of 3-1 is %s", path)
+	}
+
+	// failures are counted until RecoverAfter, a capture that succeeded starts over
+	cam := &GphotoCamera{RecoverAfter: 2}
+	cam.FilenamePrefix = "test"
+	ctx := context.Background()
+	for i, err := range []error{errors.New("failed"), nil, errors.New("failed"), errors.New("failed")} {
+		cam.handleCaptureError(ctx, err)
+		if expected := []int{1, 0, 1, 0}[i]; cam.failures != expected {
+			t.Errorf("after capture %d the camera has %d failures, expected %d", i, cam.failures, expected)
+		}
+	}
+
+	// reauthorizing gives the device a new device number, it is still found by its sysfs name after it was lost
+	root := fakeSysfs(t, true)
+	defer os.RemoveAll(root)
+	lost := &GphotoCamera{USBPort: "usb:003,003"}
+	lost.sysfsRoot = root
+	lost.rememberPort()
+	uevent := filepath.Join(root, "bus/usb/devices/3-1.2/uevent")
+	if err := ioutil.WriteFile(uevent, []byte("DEVTYPE=usb_device\nBUSNUM=003\nDEVNUM=004\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lost.rememberPort()
+	lost.USBPort = ""
+	lost.rememberPort()
+	if lost.lastDevice != "3-1.2" || lost.lastPort != "usb:003,003" {
+		t.Errorf("expected the camera to be remembered on 3-1.2 and usb:003,003, actual %s and %s", lost.lastDevice, lost.lastPort)
+	}
+}
+
+func TestMatchCamera(t *testing.T) {
+	detected := []detectedCamera{
+		{Model: "Canon EOS 1200D", Port: "usb:001,004", USBPath: "1-1.2", USBID: "04a9:3218", serialRead: true},
+		{Model: "Canon EOS 1200D", Port: "usb:001,005", USBPath: "1-1.3", USBID: "04a9:3218", serialRead: true},
+		{Model: "Nikon DSC D3200", Port: "usb:001,006", USBPath: "1-1.4", USBID: "04b0:042b",
+			SerialNumber: "3a5b29f0c1d84e6f", serialRead: true},
+	}
+	tests := []struct {
+		cam  GphotoCamera
+		port string
+		err  string
+	}{
+		{GphotoCamera{USBPath: "1-1.3"}, "usb:001,005", ""},
+		{GphotoCamera{Model: "nikon dsc d3200"}, "usb:001,006", ""},
+		{GphotoCamera{GphotoSerialNumber: "3a5b29f0c1d84e6f"}, "usb:001,006", ""},
+		{GphotoCamera{USBID: "04A9:3218", USBPath: "1-1.2"}, "usb:001,004", ""},
+		{GphotoCamera{USBID: "04a9:3218"}, "", `usbid = "04a9:3218" is ambiguous, it matches 2 cameras`},
+		{GphotoCamera{Model: "Canon EOS 1200D", Match: []string{"model"}, USBPath: "1-1.2"}, "", "ambiguous"},
+		{GphotoCamera{Model: "Canon EOS 1200D", USBPath: "1-1.4"}, "", `no gphoto2 camera with usbpath = "1-1.4", model = "Canon EOS 1200D"`},
+		{GphotoCamera{GphotoSerialNumber: "4fffa81fed8f40d2"}, "", "no gphoto2 camera"},
+	}
+	for _, test := range tests {
+		d, err := test.cam.matchCamera(context.Background(), detected)
+		if test.err == "" && (err != nil || d.Port != test.port) {
+			t.Errorf("%s expected to match %s, actual %s %v", test.cam.describeMatchers(), test.port, d.Port, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s expected %q, actual %v", test.cam.describeMatchers(), test.err, err)
+		}
+	}
+
+	// the usb path and id come from sysfs, test-data/uevent is on usb:003,003 and its hub on usb:003,002
+	root := fakeSysfs(t, false)
+	defer os.RemoveAll(root)
+	cameras := []detectedCamera{{Port: "usb:003,009"}, {Port: "usb:003,003"}}
+	describeUsbPorts(root, cameras)
+	if cameras[0].USBPath != "" || cameras[1].USBPath != "3-1.2" || cameras[1].USBID != "04d9:0169" {
+		t.Errorf("unexpected usb devices %+v", cameras)
+	}
+}
+
+func TestParseSavedFiles(t *testing.T) {
+	output := "New file is in location /capt0000.cr2 on the camera\n" +
+		"Saving file as /var/lib/eyepi/cam/cam_2018_06_01_12_00_00.cr2\n" +
+		"Deleting file /capt0000.cr2 on the camera\n" +
+		"New file is in location /capt0001.jpg on the camera\r\n" +
+		"Saving file as /var/lib/eyepi/cam/cam_2018_06_01_12_00_00.jpg\r\n" +
+		"Deleting file /capt0001.jpg on the camera\n"
+	files := parseSavedFiles(output)
+	expected := []string{"/var/lib/eyepi/cam/cam_2018_06_01_12_00_00.cr2", "/var/lib/eyepi/cam/cam_2018_06_01_12_00_00.jpg"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %q, actual %q", expected, files)
+	}
+	if preview := previewFile(files); preview != expected[1] {
+		t.Errorf("expected the jpg to be previewed, actual %s", preview)
+	}
+	if preview := previewFile(files[:1]); preview != expected[0] {
+		t.Errorf("expected the raw file to be previewed without a jpg, actual %s", preview)
+	}
+}
+
+// writeFakeRaw writes a TIFF based RAW file laid out like a CR2: IFD0 has a JPEG compressed strip with the preview
+// of width x height, IFD1 a small thumbnail and a SubIFD of IFD0 the raw data which isn't a baseline JPEG
+func writeFakeRaw(t *testing.T, path string, order binary.ByteOrder, width, height int) {
+	encode := func(w, h int) []byte {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	preview, thumbnail := encode(width, height), encode(16, 12)
+	raw := []byte{0xff, 0xd8, 0xff, 0xc3, 0, 0, 0, 0}
+
+	type entry struct {
+		tag, typ uint16
+		value    uint32
+	}
+	var buf bytes.Buffer
+	write := func(v interface{}) { binary.Write(&buf, order, v) }
+	writeIFD := func(entries []entry, next uint32) {
+		write(uint16(len(entries)))
+		for _, e := range entries {
+			write(e.tag)
+			write(e.typ)
+			write(uint32(1))
+			if e.typ == 3 {
+				write(uint16(e.value))
+				write(uint16(0))
+			} else {
+				write(e.value)
+			}
+		}
+		write(next)
+	}
+	// the header and three IFDs of 3 entries each, the images follow them
+	ifdSize := uint32(2 + 3*12 + 4)
+	ifd0, ifd1, subIFD := uint32(8), 8+ifdSize, 8+2*ifdSize
+	previewAt := 8 + 3*ifdSize
+	thumbnailAt := previewAt + uint32(len(preview))
+	rawAt := thumbnailAt + uint32(len(thumbnail))
+
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	write(uint16(42))
+	write(ifd0)
+	writeIFD([]entry{{tiffTagCompression, 3, 6}, {tiffTagStripOffsets, 4, previewAt}, {tiffTagStripByteCounts, 4, uint32(len(preview))}}, ifd1)
+	writeIFD([]entry{{tiffTagJPEGInterchange, 4, thumbnailAt}, {tiffTagJPEGInterchangeSize, 4, uint32(len(thumbnail))}, {tiffTagSubIFDs, 13, subIFD}}, 0)
+	writeIFD([]entry{{tiffTagCompression, 3, 6}, {tiffTagStripOffsets, 4, rawAt}, {tiffTagStripByteCounts, 4, uint32(len(raw))}}, 0)
+	buf.Write(preview)
+	buf.Write(thumbnail)
+	buf.Write(raw)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractRawPreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		path := filepath.Join(dir, "fake.cr2")
+		writeFakeRaw(t, path, order, 64, 48)
+		img, err := rawPreviewImage(path)
+		if err != nil {
+			t.Errorf("%s: %s", order, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 48 {
+			t.Errorf("%s: expected the 64x48 preview, actual %v", order, b)
+		}
+	}
+
+	// the preview of the CR2 written by test-data/generate_rawtest.py is generated/jpegtest.jpg, the lossless
+	// JPEG of its raw data is passed over
+	if img, err := rawPreviewImage("test-data/raw/rawtest.cr2"); err != nil {
+		t.Error(err)
+	} else if b := img.Bounds(); b.Dx() != 150 || b.Dy() != 100 {
+		t.Errorf("expected the 150x100 preview of rawtest.cr2, actual %v", b)
+	}
+
+	for path, expected := range map[string]string{
+		"test-data/jpeg/0.jpg": "not a tiff based raw file",
+		// JPEG compressed, but its strip needs the tables of the TIFF
+		"test-data/tiff/1.tiff":                  "has no jpeg preview",
+		"test-data/generated/tifftest_lzw.tif":   "has no jpeg preview",
+		"test-data/generated/does_not_exist.cr2": "no such file",
+	} {
+		if _, err := rawPreviewImage(path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected %q, actual %v", path, expected, err)
+		}
+	}
+
+	// a RAW only camera still updates last_image.jpg and records the files of every frame
+	raw := filepath.Join(dir, "raw.cr2")
+	writeFakeRaw(t, raw, binary.LittleEndian, 64, 48)
+	script := `for arg in "$@"; do
+	case "$arg" in
+	--filename=*) file="$(echo "${arg#--filename=}" | sed 's/%C/cr2/')";;
+	esac
+done
+cp "` + raw + `" "$file" && echo "Saving file as $file"
+`
+	defer fakeGphoto2(t, script)()
+
+	cam := &GphotoCamera{USBPort: "usb:001,006"}
+	cam.OutputDir, cam.FilenamePrefix, cam.Burst = dir, "cam", 2
+	cam.CaptureTimeout.Duration = time.Second * 10
+	if err := cam.captureFrames(context.Background(), "2018_06_01_12_00_00", nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "cam_2018_06_01_12_00_00_00.cr2"), filepath.Join(dir, "cam_2018_06_01_12_00_00_01.cr2")}
+	if files := cam.takeFiles(); !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected the files %q, actual %q", expected, files)
+	}
+	f, err := os.Open(filepath.Join(dir, "last_image.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if config, err := jpeg.DecodeConfig(f); err != nil || config.Width != 64 {
+		t.Errorf("expected last_image.jpg from the preview, actual %+v %v", config, err)
+	}
+}
+
+// encodeLosslessJPEG encodes samples with their components interleaved as a lossless JPEG with predictor and a
+// restart marker every restart samples. Every difference category has a 5 bit huffman code.
+func encodeLosslessJPEG(samples []uint16, width, height, components, precision, predictor, restart int) []byte {
+	var out bytes.Buffer
+	write := func(v ...interface{}) {
+		for _, value := range v {
+			binary.Write(&out, binary.BigEndian, value)
+		}
+	}
+	counts, values := make([]byte, 16), make([]byte, 17)
+	counts[4] = 17
+	for s := range values {
+		values[s] = byte(s)
+	}
+	write(uint16(0xffd8), uint16(0xffc4), uint16(2+1+16+17), byte(0), counts, values)
+	write(uint16(0xffc3), uint16(8+3*components), byte(precision), uint16(height), uint16(width), byte(components))
+	for c := 0; c < components; c++ {
+		write(byte(c+1), byte(0x11), byte(0))
+	}
+	if restart > 0 {
+		write(uint16(0xffdd), uint16(4), uint16(restart))
+	}
+	write(uint16(0xffda), uint16(6+2*components), byte(components))
+	for c := 0; c < components; c++ {
+		write(byte(c+1), byte(0))
+	}
+	write(byte(predictor), byte(0), byte(0))
+
+	var acc byte
+	var n uint
+	put := func(v int32, bits uint) {
+		for i := bits; i > 0; i-- {
+			acc = acc<<1 | byte(v>>(i-1)&1)
+			if n++; n == 8 {
+				out.WriteByte(acc)
+				if acc == 0xff {
+					out.WriteByte(0)
+				}
+				acc, n = 0, 0
+			}
+		}
+	}
+	flush := func() {
+		for n != 0 {
+			put(1, 1)
+		}
+	}
+
+	stride := width * components
+	firstX, firstY, marker := 0, 0, 0
+	for y, i := 0, 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if restart > 0 && i > 0 && i%restart == 0 {
+				flush()
+				write(uint16(0xffd0 + marker%8))
+				marker++
+				firstX, firstY = x, y
+			}
+			i++
+			for c := 0; c < components; c++ {
+				at := y*stride + x*components + c
+				var p int32
+				switch {
+				case x == firstX && y == firstY:
+					p = 1 << uint(precision-1)
+				case y == firstY:
+					p = int32(samples[at-components])
+				case x == 0:
+					p = int32(samples[at-stride])
+				default:
+					ra, rb, rc := int32(samples[at-components]), int32(samples[at-stride]), int32(samples[at-stride-components])
+					p = []int32{0, ra, rb, rc, ra + rb - rc, ra + (rb-rc)>>1, rb + (ra-rc)>>1, (ra + rb) >> 1}[predictor]
+				}
+				d := (int32(samples[at]) - p) & (1<<uint(precision) - 1)
+				if d >= 1<<uint(precision-1) {
+					d -= 1 << uint(precision)
+				}
+				s := uint(0)
+				for abs := d; abs != 0; abs /= 2 {
+					s++
+				}
+				put(int32(s), 5)
+				if d < 0 {
+					d += 1<<s - 1
+				}
+				put(d, s)
+			}
+		}
+	}
+	flush()
+	write(uint16(0xffd9))
+	return out.Bytes()
+}
+
+// testSamples returns n pseudo random samples of precision bits
+func testSamples(n, precision int) []uint16 {
+	samples := make([]uint16, n)
+	x := uint32(1)
+	for i := range samples {
+		x = x*1103515245 + 12345
+		samples[i] = uint16(x >> 8 & (1<<uint(precision) - 1))
+	}
+	return samples
+}
+
+func TestLosslessJPEG(t *testing.T) {
+	for _, test := range []struct {
+		width, height, components, precision, predictor, restart int
+	}{
+		{6, 5, 2, 12, 1, 0},
+		{6, 5, 2, 14, 2, 0},
+		{6, 5, 2, 14, 3, 0},
+		{6, 5, 4, 14, 4, 0},
+		{6, 5, 2, 16, 5, 0},
+		{6, 5, 2, 12, 6, 0},
+		{6, 5, 1, 12, 7, 0},
+		{6, 5, 2, 14, 1, 6},
+		{6, 5, 2, 14, 6, 4},
+	} {
+		samples := testSamples(test.width*test.height*test.components, test.precision)
+		data := encodeLosslessJPEG(samples, test.width, test.height, test.components, test.precision, test.predictor, test.restart)
+		j, err := decodeLosslessJPEG(data)
+		if err != nil {
+			t.Errorf("%+v: %s", test, err)
+			continue
+		}
+		if j.width != test.width || j.height != test.height || j.components != test.components || !reflect.DeepEqual(j.data, samples) {
+			t.Errorf("%+v: decoded %dx%dx%d %v, expected %v", test, j.width, j.height, j.components, j.data, samples)
+		}
+	}
+
+	// a frame header of 65535x65535 with a few bytes of data must not allocate the samples
+	data := encodeLosslessJPEG(testSamples(4, 12), 2, 1, 2, 12, 1, 0)
+	sof := bytes.Index(data, []byte{0xff, 0xc3})
+	binary.BigEndian.PutUint16(data[sof+5:], 0xffff)
+	binary.BigEndian.PutUint16(data[sof+7:], 0xffff)
+	if _, err := decodeLosslessJPEG(data); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("expected an oversized frame header to be rejected, actual %v", err)
+	}
+
+	var baseline bytes.Buffer
+	jpeg.Encode(&baseline, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if _, err := decodeLosslessJPEG(baseline.Bytes()); err == nil || !strings.Contains(err.Error(), "not a lossless jpeg") {
+		t.Errorf("expected a baseline jpeg to be rejected, actual %v", err)
+	}
+}
+
+type testTiffEntry struct {
+	tag, typ     uint16
+	count, value uint32
+}
+
+// fakeTiff returns a little endian TIFF of header, a single IFD with entries and data after it.
+// entries and data get the offset of data.
+func fakeTiff(header []byte, entries func(dataAt uint32) []testTiffEntry, data func(dataAt uint32) []byte) []byte {
+	var buf bytes.Buffer
+	write := func(v ...interface{}) {
+		for _, value := range v {
+			binary.Write(&buf, binary.LittleEndian, value)
+		}
+	}
+	copy(header, "II*\x00")
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(header)))
+	buf.Write(header)
+	n := len(entries(0))
+	dataAt := uint32(len(header) + 2 + n*12 + 4)
+	write(uint16(n))
+	for _, e := range entries(dataAt) {
+		write(e.tag, e.typ, e.count, e.value)
+	}
+	write(uint32(0))
+	buf.Write(data(dataAt))
+	return buf.Bytes()
+}
+
+func TestDecodeRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a CR2 of 8x4 in a slice of 4 and a last slice of 4 columns, its IFD0 is also the raw IFD. The Exif IFD,
+	// the maker note and its sensor info follow the slices.
+	width, height := 8, 4
+	raw := testSamples(width*height, 14)
+	var sliced []uint16
+	for slice := 0; slice < 2; slice++ {
+		for y := 0; y < height; y++ {
+			sliced = append(sliced, raw[y*width+slice*4:y*width+slice*4+4]...)
+		}
+	}
+	jpg := encodeLosslessJPEG(sliced, 2, len(sliced)/4, 2, 14, 1, 0)
+	cr2 := func(infoTag uint16, left, top, right, bottom uint16) []byte {
+		header := make([]byte, 16)
+		copy(header[8:], "CR\x02\x00\x10\x00\x00\x00")
+		return fakeTiff(header, func(dataAt uint32) []testTiffEntry {
+			return []testTiffEntry{
+				{tiffTagCompression, 3, 1, 6},
+				{tiffTagStripOffsets, 4, 1, dataAt + 76},
+				{tiffTagStripByteCounts, 4, 1, uint32(len(jpg))},
+				{tiffTagExifIFD, 4, 1, dataAt + 6},
+				{tiffTagCR2Slices, 3, 3, dataAt},
+			}
+		}, func(dataAt uint32) []byte {
+			var buf bytes.Buffer
+			write := func(v ...interface{}) {
+				for _, value := range v {
+					binary.Write(&buf, binary.LittleEndian, value)
+				}
+			}
+			write([]uint16{1, 4, 4})
+			write(uint16(1), testTiffEntry{tiffTagMakerNote, 7, 52, dataAt + 24}, uint32(0))
+			write(uint16(1), testTiffEntry{infoTag, 3, 17, dataAt + 42}, uint32(0))
+			write([17]uint16{34, uint16(width), uint16(height), 0, 0, left, top, right, bottom})
+			buf.Write(jpg)
+			return buf.Bytes()
+		})
+	}
+	cr2Path := filepath.Join(dir, "fake.cr2")
+	if err := ioutil.WriteFile(cr2Path, cr2(canonTagSensorInfo, 2, 2, 7, 3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeRaw(cr2Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var active []uint16
+	for y := 2; y < height; y++ {
+		active = append(active, raw[y*width+2:y*width+width]...)
+	}
+	if decoded.width != 6 || decoded.height != 2 || decoded.bits != 14 || !reflect.DeepEqual(decoded.data, active) {
+		t.Errorf("cr2 decoded as %dx%d of %d bits %v, expected 6x2 %v", decoded.width, decoded.height, decoded.bits, decoded.data, active)
+	}
+	for _, test := range []struct {
+		infoTag                  uint16
+		left, top, right, bottom uint16
+		err                      string
+	}{
+		{0xe1, 2, 2, 7, 3, "no sensor info"},
+		{canonTagSensorInfo, 1, 2, 7, 3, "sensor borders at 1,2 aren't supported"},
+		{canonTagSensorInfo, 2, 2, 8, 3, "outside the 8x4 sensor"},
+	} {
+		if err := ioutil.WriteFile(cr2Path, cr2(test.infoTag, test.left, test.top, test.right, test.bottom), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decodeRaw(cr2Path); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: expected %q, actual %v", test, test.err, err)
+		}
+	}
+
+	// a DNG of 6x4 GRBG with every colour the same behind a masked border of a column, encoded as two
+	// components like cameras do. The pattern starts at the active area.
+	width, height = 6, 4
+	colours := [3]uint16{100, 500, 900}
+	cfa := [4]int{1, 0, 2, 1}
+	raw = make([]uint16, (width+2)*height)
+	for i := range raw {
+		if x, y := i%(width+2)-1, i/(width+2); x >= 0 && x < width {
+			raw[i] = colours[cfa[y%2*2+x%2]]
+		}
+	}
+	jpg = encodeLosslessJPEG(raw, width/2+1, height, 2, 12, 1, 0)
+	dng := fakeTiff(make([]byte, 8), func(dataAt uint32) []testTiffEntry {
+		return []testTiffEntry{
+			{tiffTagNewSubfileType, 4, 1, 0},
+			{tiffTagImageWidth, 4, 1, uint32(width + 2)},
+			{tiffTagImageLength, 4, 1, uint32(height)},
+			{tiffTagBitsPerSample, 3, 1, 12},
+			{tiffTagCompression, 3, 1, compressionLosslessJPG},
+			{tiffTagPhotometric, 3, 1, photometricCFA},
+			{tiffTagStripOffsets, 4, 1, dataAt + 8},
+			{tiffTagRowsPerStrip, 4, 1, uint32(height)},
+			{tiffTagStripByteCounts, 4, 1, uint32(len(jpg))},
+			{tiffTagCFARepeatDim, 3, 2, 2 | 2<<16},
+			{tiffTagCFAPattern, 1, 4, 1 | 0<<8 | 2<<16 | 1<<24},
+			{tiffTagDNGVersion, 1, 4, 1 | 4<<8},
+			{tiffTagActiveArea, 3, 4, dataAt},
+		}
+	}, func(uint32) []byte {
+		return append([]byte{0, 0, 1, 0, byte(height), 0, byte(width + 1), 0}, jpg...)
+	})
+	dngPath := filepath.Join(dir, "fake.dng")
+	if err := ioutil.WriteFile(dngPath, dng, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the TIFF has the colours of every pixel scaled from 12 to 16 bits
+	cam := &GphotoCamera{ConvertRaw: true}
+	converted := cam.postProcess([]string{filepath.Join(dir, "fake.jpg"), dngPath})
+	tiffPath := filepath.Join(dir, "fake.tiff")
+	if !reflect.DeepEqual(converted, []string{tiffPath}) {
+		t.Fatalf("expected %s to be converted, actual %q", dngPath, converted)
+	}
+	f, err := os.Open(tiffPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+		t.Errorf("expected a %dx%d tiff, actual %v", width, height, b)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if r, g, b, _ := img.At(x, y).RGBA(); r != 100<<4 || g != 500<<4 || b != 900<<4 {
+				t.Errorf("pixel %d,%d is %d,%d,%d", x, y, r, g, b)
+			}
+		}
+	}
+
+	if _, err := decodeRaw("test-data/generated/tifftest.tif"); err == nil || !strings.Contains(err.Error(), "neither a CR2 nor a DNG") {
+		t.Errorf("expected a plain tiff to be rejected, actual %v", err)
+	}
+
+	// written by test-data/generate_rawtest.py, their active areas have (colour+1)*600 + 4*x + 8*y.
+	// rawtest.dng is a big endian DNG with a thumbnail IFD, the CFA image in a SubIFD in two tiles of 8x8.
+	// rawtest.cr2 has its raw data in two slices of 4 columns and one of 6, the masked borders around the
+	// active area are in the sensor info of its maker note.
+	for _, test := range []struct {
+		path          string
+		width, height int
+		cfa           [2][2]int
+		values        [][3]int
+		// the colours of the pixel at 1,1 in the tiff
+		r, g, b uint32
+	}{
+		{"test-data/raw/rawtest.dng", 14, 8, [2][2]int{{2, 1}, {1, 0}},
+			[][3]int{{0, 0, 1800}, {1, 0, 1204}, {0, 1, 1208}, {1, 1, 612}, {8, 3, 1256}, {13, 7, 708}},
+			612, 1212, 1812},
+		{"test-data/raw/rawtest.cr2", 10, 4, [2][2]int{{0, 1}, {1, 2}},
+			[][3]int{{0, 0, 600}, {1, 0, 1204}, {0, 1, 1208}, {1, 1, 1812}, {5, 2, 1236}, {9, 3, 1860}},
+			612, 1212, 1812},
+	} {
+		decoded, err := decodeRaw(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.width != test.width || decoded.height != test.height || decoded.bits != 12 || decoded.cfa != test.cfa {
+			t.Errorf("%s decoded as %dx%d of %d bits %v", test.path, decoded.width, decoded.height, decoded.bits, decoded.cfa)
+			continue
+		}
+		for _, v := range test.values {
+			if actual := decoded.data[v[1]*decoded.width+v[0]]; int(actual) != v[2] {
+				t.Errorf("%s %d,%d is %d, expected %d", test.path, v[0], v[1], actual, v[2])
+			}
+		}
+
+		tiffPath := filepath.Join(dir, filepath.Base(test.path)+".tiff")
+		if err := convertRaw(test.path, tiffPath); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(tiffPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the colour of the pixel with green from its four neighbours and the third colour from its diagonals
+		if r, g, b, _ := img.At(1, 1).RGBA(); r != test.r<<4 || g != test.g<<4 || b != test.b<<4 {
+			t.Errorf("%s 1,1 is %d,%d,%d, expected %d,%d,%d", tiffPath, r, g, b, test.r<<4, test.g<<4, test.b<<4)
+		}
+	}
+}
+
+func TestParseFileList(t *testing.T) {
+	output := `There is no file in folder '/'.
+There is no file in folder '/store_00020001'.
+There are 3 files in folder '/store_00020001/DCIM/100CANON':
+#1     IMG_0001.CR2               rd 24413 KB image/x-canon-cr2 1527854400
+#2     IMG_0001.JPG               rd  5432 KB  5184x3456 image/jpeg 1527854400
+#3     IMG_0002.JPG               rd  5401 KB  5184x3456 image/jpeg 1527854460
+There is 1 file in folder '/store_00020001/DCIM/101CANON':
+#1     IMG_0100.JPG               rd  5401 KB  5184x3456 image/jpeg 1527854520
+`
+	expected := map[string]cardFile{
+		"/store_00020001/DCIM/100CANON/IMG_0001.CR2": {"/store_00020001/DCIM/100CANON/IMG_0001.CR2", 1},
+		"/store_00020001/DCIM/100CANON/IMG_0001.JPG": {"/store_00020001/DCIM/100CANON/IMG_0001.JPG", 2},
+		"/store_00020001/DCIM/100CANON/IMG_0002.JPG": {"/store_00020001/DCIM/100CANON/IMG_0002.JPG", 3},
+		"/store_00020001/DCIM/101CANON/IMG_0100.JPG": {"/store_00020001/DCIM/101CANON/IMG_0100.JPG", 1},
+	}
+	if actual := parseFileList(output); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, actual %v", expected, actual)
+	}
+	if actual := parseCardFiles("New file is in location /store_00020001/DCIM/100CANON/IMG_0001.CR2 on the camera\r\n" +
+		"New file is in location /store_00020001/DCIM/100CANON/IMG_0001.JPG on the camera\n"); !reflect.DeepEqual(actual,
+		[]string{"/store_00020001/DCIM/100CANON/IMG_0001.CR2", "/store_00020001/DCIM/100CANON/IMG_0001.JPG"}) {
+		t.Errorf("unexpected card files %q", actual)
+	}
+}
+
+func TestCaptureToCard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	card, broken := filepath.Join(dir, "card"), filepath.Join(dir, "broken")
+	jpg, err := filepath.Abs("test-data/jpeg/0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a camera with a single folder on its card, files are numbered in the order ls lists them. While broken
+	// exists there is another folder with a file that can't be downloaded.
+	script := `card="` + card + `"
+folder=/store_00020001/DCIM/100CANON
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--capture-image)
+		n=$(($(ls "$card" | wc -l) / 2 + 1))
+		name=$(printf 'IMG_%04d' $n)
+		cp "` + jpg + `" "$card/$name.JPG" && touch "$card/$name.CR2"
+		echo "New file is in location $folder/$name.CR2 on the camera"
+		echo "New file is in location $folder/$name.JPG on the camera";;
+	--list-files)
+		echo "There are $(ls "$card" | wc -l) files in folder '$folder':"
+		ls "$card" | awk '{ printf "#%-5d %s  rd 10 KB image/jpeg\n", NR, $0 }'
+		[ -e "` + broken + `" ] && printf "There is 1 file in folder '/store_00020001/DCIM/999CANON':\n#1     IMG_9999.JPG  rd 10 KB image/jpeg\n";;
+	--folder) shift; [ "$1" = $folder ] || exit 1;;
+	--filename) shift; pattern="$1";;
+	--get-file) shift; get="$1";;
+	--delete-file) shift; rm "$card/$(ls "$card" | sed -n "$1p")";;
+	esac
+	shift
+done
+for i in $(echo "$get" | tr , ' '); do
+	f=$(ls "$card" | sed -n "${i}p")
+	out=$(echo "$pattern" | sed "s/%f/${f%.*}/; s/%C/${f##*.}/")
+	cp "$card/$f" "$out" && echo "Saving file as $out"
+done
+`
+	if err := os.MkdirAll(card, 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer fakeGphoto2(t, script)()
+
+	cam := &GphotoCamera{USBPort: "usb:001,006", CaptureToCard: true}
+	cam.OutputDir, cam.FilenamePrefix, cam.Burst = filepath.Join(dir, "out"), "cam", 1
+	cam.CaptureTimeout.Duration = time.Second * 10
+	if err := os.MkdirAll(cam.OutputDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, timestamp := range []string{"2018_06_01_12_00_00", "2018_06_01_12_01_00"} {
+		if err := cam.captureFrames(ctx, timestamp, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files := cam.takeFiles(); len(files) != 0 {
+		t.Errorf("expected nothing downloaded by the captures, actual %q", files)
+	}
+
+	// the files of the first folder are post processed although the second fails
+	if err := ioutil.WriteFile(broken, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.recordCardFiles([]string{"/store_00020001/DCIM/999CANON/IMG_9999.JPG"}, "cam_2018_06_01_12_02_00"); err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := cam.downloadFromCard(ctx)
+	if err == nil {
+		t.Error("expected the download of the second folder to fail")
+	}
+	sort.Strings(downloaded)
+	expected := []string{
+		filepath.Join(cam.OutputDir, "cam_2018_06_01_12_00_00.cr2"),
+		filepath.Join(cam.OutputDir, "cam_2018_06_01_12_00_00.jpg"),
+		filepath.Join(cam.OutputDir, "cam_2018_06_01_12_01_00.cr2"),
+		filepath.Join(cam.OutputDir, "cam_2018_06_01_12_01_00.jpg"),
+	}
+	if !reflect.DeepEqual(downloaded, expected) {
+		t.Errorf("expected the files %q, actual %q", expected, downloaded)
+	}
+	if _, err := os.Stat(filepath.Join(cam.OutputDir, "last_image.jpg")); err != nil {
+		t.Errorf("expected last_image.jpg from the latest frame: %s", err)
+	}
+	os.Remove(broken)
+
+	// a restarted go-eyepi doesn't download them again
+	cam = &GphotoCamera{USBPort: cam.USBPort, CaptureToCard: true, DeleteFromCard: true, CameraConfig: cam.CameraConfig}
+	if downloaded, err := cam.downloadFromCard(ctx); err != nil || len(downloaded) != 0 {
+		t.Errorf("expected nothing new on the card, actual %q %v", downloaded, err)
+	}
+	if remaining, _ := ioutil.ReadDir(card); len(remaining) != 0 {
+		t.Errorf("expected the downloaded files deleted from the card, %d are left", len(remaining))
+	}
+	record, err := cam.loadCardRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Pending) != 0 || len(record.Fetched) != 0 {
+		t.Errorf("expected an empty record after deleting the files, actual %+v", record)
+	}
+}
+
+func TestParseStorageInfo(t *testing.T) {
+	output := `[Storage 0]
+label=SD
+mountpoint=/store_00020001
+description=SD
+basedir=/store_00020001
+access=0 - Read-Write
+type=2 - Removable RAM (memory card)
+fstype=2 - Digital Camera Layout (DCIM)
+totalcapacity=15548672 KB
+free=1417312 KB
+freeimages=1866
+[Storage 1]
+basedir=/store_00010001
+`
+	expected := []storageInfo{
+		{BaseDir: "/store_00020001", Label: "SD", TotalKB: 15548672, FreeKB: 1417312, FreeImages: 1866},
+		{BaseDir: "/store_00010001", TotalKB: -1, FreeKB: -1, FreeImages: -1},
+	}
+	storages := parseStorageInfo(output)
+	if !reflect.DeepEqual(storages, expected) {
+		t.Fatalf("expected %+v, actual %+v", expected, storages)
+	}
+	if percent, ok := storages[0].freePercent(); !ok || percent != 9 {
+		t.Errorf("expected 9%% free, actual %d %t", percent, ok)
+	}
+	if _, ok := storages[1].freePercent(); ok {
+		t.Errorf("expected no free percentage without a capacity")
+	}
+
+	for value, expected := range map[string]int{"75%": 75, "100": 100, " 5 %": 5, "Full": -1, "": -1} {
+		percent, ok := parseBatteryLevel(value)
+		if !ok {
+			percent = -1
+		}
+		if percent != expected {
+			t.Errorf("battery level %q: expected %d, actual %d", value, expected, percent)
+		}
+	}
+}
+
+func TestHousekeep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a camera with a clock, but without a battery level
+	script := `case "$*" in
+*"--get-config batterylevel"*) echo "*** Error: batterylevel not found in configuration tree. ***" >&2; exit 1;;
+*"--get-config datetime"*) printf 'Label: Camera Date and Time\nType: DATE\nCurrent: 1527854400\nPrintable: Fri Jun  1 12:00:00 2018\nEND\n';;
+*"--set-config datetime=now"*) touch "` + filepath.Join(dir, "clock-set") + `";;
+*--storage-info*) printf '[Storage 0]\nbasedir=/store_00020001\ntotalcapacity=1000 KB\nfree=50 KB\nfreeimages=3\n';;
+*) exit 1;;
+esac
+`
+	defer fakeGphoto2(t, script)()
+
+	cam := &GphotoCamera{USBPort: "usb:001,006", SyncClock: true, BatteryWarning: 20, StorageWarning: 10}
+	cam.FilenamePrefix = "cam"
+	cam.CaptureTimeout.Duration = time.Second * 10
+	measurements := make(chan telegraf.Measurement, 10)
+	cam.housekeep(context.Background(), measurements)
+
+	// the clock offset, and the storage below its warning
+	if len(measurements) != 2 {
+		t.Errorf("expected 2 measurements, actual %d", len(measurements))
+	}
+	if !cam.missingConfigs["batterylevel"] || cam.batteryLow {
+		t.Errorf("expected the camera to have no battery level, actual %v", cam.missingConfigs)
+	}
+	if !cam.storageLow["/store_00020001"] {
+		t.Errorf("expected the storage to be low")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "clock-set")); err != nil || cam.clockSynced.IsZero() {
+		t.Errorf("expected the clock to be set: %v", err)
+	}
+
+	// the clock is only set once a day
+	os.Remove(filepath.Join(dir, "clock-set"))
+	cam.housekeep(context.Background(), make(chan telegraf.Measurement, 10))
+	if _, err := os.Stat(filepath.Join(dir, "clock-set")); err == nil {
+		t.Errorf("expected the clock not to be set again")
+	}
+}
+
+func TestFocusScore(t *testing.T) {
+	sharp := image.NewGray(image.Rect(0, 0, 32, 32))
+	blurred := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if (x/4+y/4)%2 == 0 {
+				sharp.Pix[y*32+x] = 255
+			}
+			// the same pattern seen through a box blur
+			var sum int
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					if ((x+dx+8)/4+(y+dy+8)/4)%2 == 0 {
+						sum += 255
+					}
+				}
+			}
+			blurred.Pix[y*32+x] = uint8(sum / 25)
+		}
+	}
+	flat := image.NewGray(image.Rect(0, 0, 32, 32))
+
+	if s := focusScore(flat); s != 0 {
+		t.Errorf("expected a flat image to score 0, actual %f", s)
+	}
+	if s, b := focusScore(sharp), focusScore(blurred); s <= b || b <= 0 {
+		t.Errorf("expected the sharp image to score higher than the blurred one, actual %f and %f", s, b)
+	}
+	if s := focusScore(image.NewGray(image.Rect(0, 0, 2, 2))); s != 0 {
+		t.Errorf("expected a tiny image to score 0, actual %f", s)
+	}
+
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jpg, err := filepath.Abs("test-data/jpeg/0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := `while [ $# -gt 0 ]; do
+	case "$1" in
+	--filename) shift; file="$(echo "$1" | sed 's/%C/jpg/')";;
+	esac
+	shift
+done
+cp "` + jpg + `" "$file" && echo "Saving file as $file"
+`
+	defer fakeGphoto2(t, script)()
+
+	cam := &GphotoCamera{USBPort: "usb:001,006"}
+	cam.FilenamePrefix = "cam"
+	cam.CaptureTimeout.Duration = time.Second * 10
+	img, err := cam.capturePreview(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := focusScore(img); s <= 0 {
+		t.Errorf("expected a score for the preview, actual %f", s)
+	}
+}
+
+// fakeGphoto2 puts a gphoto2 shell script of its own directory first on the PATH, the function it returns takes it
+// off again
+func fakeGphoto2(t *testing.T, script string) func() {
+	dir, err := ioutil.TempDir("", "go-eyepi-gphoto2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "gphoto2"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+// runnerCaptures records the timestamps captured by runnerCameras by their FilenamePrefix
+var runnerCaptures = struct {
+	sync.Mutex
+	timestamps map[string][]string
+}{timestamps: make(map[string][]string)}
+
+//runnerCamera is a camera of the fake backend the runner tests load from config, it records its captures
+type runnerCamera struct {
+	CameraConfig
+	// Delay is how long a capture takes
+	Delay duration
+}
+
+func init() {
+	registerCameraBackend("fake", cameraBackend{
+		newCamera: func() Camera { return &runnerCamera{CameraConfig: CameraConfig{Enable: true}} },
+	})
+}
+
+func (cam *runnerCamera) capture(ctx context.Context, timestamp string) error {
+	return cam.captureFrames(ctx, timestamp, nil)
+}
+
+func (cam *runnerCamera) captureFrames(ctx context.Context, timestamp string, sync *syncPoint) error {
+	if err := sync.wait(ctx); err != nil {
+		return err
+	}
+	sync.shutter()
+	time.Sleep(cam.Delay.Duration)
+	runnerCaptures.Lock()
+	defer runnerCaptures.Unlock()
+	runnerCaptures.timestamps[cam.FilenamePrefix] = append(runnerCaptures.timestamps[cam.FilenamePrefix], timestamp)
+	return nil
+}
+
+func (cam *runnerCamera) Describe() string { return cam.describe() }
+
+func (cam *runnerCamera) Health(ctx context.Context) error { return nil }
+
+// loadTestConfig loads conf with fake cameras capturing every second into dir
+func loadTestConfig(t *testing.T, dir, conf string) *GlobalConfig {
+	path := filepath.Join(dir, "eyepi.conf")
+	conf = "[rpicamera]\nenable = false\n" + strings.Replace(conf, "OUTPUT", dir, -1)
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// checkCaptures checks that the timestamps of every camera in prefixes were captured once each, consecutive ones
+// without a missed second in between
+func checkCaptures(t *testing.T, consecutive bool, prefixes ...string) {
+	runnerCaptures.Lock()
+	defer runnerCaptures.Unlock()
+	for _, prefix := range prefixes {
+		timestamps := runnerCaptures.timestamps[prefix]
+		if len(timestamps) == 0 {
+			t.Errorf("%s didn't capture", prefix)
+			continue
+		}
+		var last time.Time
+		for _, timestamp := range timestamps {
+			tp, err := time.ParseInLocation("2006_01_02_15_04_05", timestamp, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case !last.IsZero() && !tp.After(last):
+				t.Errorf("%s captured %s twice or out of order: %q", prefix, timestamp, timestamps)
+			case consecutive && !last.IsZero() && tp.Sub(last) != time.Second:
+				t.Errorf("%s missed the timepoints before %s: %q", prefix, timestamp, timestamps)
+			}
+			last = tp
+		}
+	}
+}
+
+func TestRunnerApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	camera := func(name, extra string) string {
+		return fmt.Sprintf("[fake.%s]\nfilenameprefix = %q\noutputdir = \"OUTPUT\"\nschedule = [\"* * * * * *\"]\n%s\n", name, name, extra)
+	}
+
+	runnerCaptures.Lock()
+	runnerCaptures.timestamps = make(map[string][]string)
+	runnerCaptures.Unlock()
+
+	r := newCameraRunner(context.Background(), func(telegraf.Measurement) {})
+	// the changed camera is stopped during a capture that overran, it resumes from a timepoint that already passed
+	r.apply(loadTestConfig(t, dir, camera("unchanged", "")+camera("changed", `delay = "1200ms"`)+camera("removed", "")))
+	time.Sleep(time.Millisecond * 1500)
+	unchanged := r.running["unchanged"].cam
+
+	r.apply(loadTestConfig(t, dir, camera("unchanged", "")+camera("changed", "")+camera("added", "")))
+	if r.running["unchanged"].cam != unchanged {
+		t.Error("restarted the unchanged camera")
+	}
+	for name, expected := range map[string]bool{"changed": true, "removed": false, "added": true} {
+		if _, running := r.running[name]; running != expected {
+			t.Errorf("%s: expected running %t", name, expected)
+		}
+	}
+	time.Sleep(time.Millisecond * 1500)
+	if !r.stopAll(time.Second * 5) {
+		t.Fatal("cameras still running")
+	}
+	checkCaptures(t, true, "unchanged", "changed", "removed", "added")
+}
+
+func TestRunnerApplyGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runnerCaptures.Lock()
+	runnerCaptures.timestamps = make(map[string][]string)
+	runnerCaptures.Unlock()
+	x := "[fake.x]\nfilenameprefix = \"x\"\noutputdir = \"OUTPUT\"\nschedule = [\"* * * * * *\"]\n"
+	group := "[group.g]\ncameras = [\"x\"]\noutputdir = \"OUTPUT\"\nschedule = [\"* * * * * *\"]\n"
+
+	r := newCameraRunner(context.Background(), func(telegraf.Measurement) {})
+	r.apply(loadTestConfig(t, dir, x))
+	time.Sleep(time.Millisecond * 1500)
+
+	// x only captures with the group it joined
+	r.apply(loadTestConfig(t, dir, x+group))
+	if _, running := r.running["x"]; running {
+		t.Error("x still runs on its own in a group")
+	}
+	if _, running := r.running["g"]; !running {
+		t.Error("the new group isn't running")
+	}
+	time.Sleep(time.Millisecond * 1500)
+
+	// and on its own again once it left
+	r.apply(loadTestConfig(t, dir, x))
+	if rc, running := r.running["x"]; !running || rc.cam.Config().group != "" {
+		t.Error("x doesn't run on its own after leaving the group")
+	}
+	if _, running := r.running["g"]; running {
+		t.Error("the removed group is still running")
+	}
+	time.Sleep(time.Millisecond * 1500)
+	if !r.stopAll(time.Second * 5) {
+		t.Fatal("cameras still running")
+	}
+	checkCaptures(t, false, "x")
+}
+
+func TestLostCamera(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-eyepi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the camera stops answering on its port, --auto-detect finds it again or not at all
+	for _, data := range []struct {
+		detected  string
+		transient bool
+	}{
+		{"Canon EOS 650D                 usb:001,007", true},
+		{"", false},
+	} {
+		script := `case "$*" in
+*--auto-detect*) printf 'Model                          Port\n----------------------------------------------------------\n` + data.detected + `\n';;
+*) echo "*** Error: No camera found. ***" >&2; exit 1;;
+esac
+`
+		restore := fakeGphoto2(t, script)
+		cam := &GphotoCamera{USBPort: "usb:001,006"}
+		cam.OutputDir, cam.FilenamePrefix, cam.Burst = dir, "cam", 1
+		cam.CaptureTimeout.Duration = time.Second * 10
+		err := cam.capture(context.Background(), "2018_06_01_12_00_00")
+		restore()
+		if err == nil || isTransient(err) != data.transient || errorKind(err) != string(modelNotFound) {
+			t.Errorf("%q: expected a transient %t %s, actual %v", data.detected, data.transient, modelNotFound, err)
+		}
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"github.com/mdaffin/go-telegraf"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,258 +17,531 @@ const getInUseUsbRe = "usb:(\\d+),(\\d+)"
 
 var /* const */ snRegexp = regexp.MustCompile(getSerialNumberRe)
 var /* const */ usbRegexp = regexp.MustCompile(getInUseUsbRe)
+var /* const */ savedFileRegexp = regexp.MustCompile(`(?m)^Saving file as (.+?)\r?$`)
 
 //GphotoCamera type to support gphoto2 cameras through cli interaction
 type GphotoCamera struct {
-	Enable                      bool
-	Interval                    duration
-	FilenamePrefix, OutputDir   string
+	CameraConfig
 	GphotoSerialNumber, USBPort string
+	// USBPath is the physical port the camera is plugged into, eg 1-1.3 for port 3 of the hub on port 1 of bus 1,
+	// USBID its usb vendor:product id and Model its model as listed by gphoto2 --auto-detect.
+	// Cameras are found by any of these and GphotoSerialNumber that are set, all of them must match.
+	USBPath, USBID, Model string
+	// Match is the order the camera is matched in, eg ["usbpath", "model"], by default the ones that are set in the
+	// order usbpath, usbid, model, gphotoserialnumber
+	Match []string
+	// Bracket takes a frame (or Burst frames) for every value of BracketConfig, eg ["-2", "0", "+2"]
+	Bracket []string
+	// BracketConfig is the gphoto2 config the Bracket values are set on, exposurecompensation by default
+	BracketConfig string
+	// Settings are gphoto2 configs set when the camera is started, eg {iso = "200", shutterspeed = "1/125"}.
+	// With SettingsEveryCapture they are set again before every capture, in case the camera was reset or touched.
+	Settings             map[string]string
+	SettingsEveryCapture bool
+	// ConvertRaw decodes the CR2 and DNG files of every capture into a linear 16 bit TIFF next to them
+	ConvertRaw bool
+	// CaptureToCard leaves the frames on the card of the camera (capturetarget=1) instead of downloading every one
+	// as it is captured. They are downloaded in batches every DownloadInterval, or at the times of DownloadSchedule,
+	// and deleted from the card afterwards with DeleteFromCard.
+	CaptureToCard    bool
+	DownloadInterval duration
+	DownloadSchedule []cronSchedule
+	DeleteFromCard   bool
+	// HousekeepingInterval is how often the battery level and free space of the camera are measured, 0 (the
+	// default) never. A warning is logged when they fall below BatteryWarning and StorageWarning percent.
+	// SyncClock sets the clock of the camera to the one of the computer once a day while housekeeping, off by default.
+	HousekeepingInterval           duration
+	BatteryWarning, StorageWarning int
+	SyncClock                      bool
+	// RecoverAfter is the number of captures in a row that may fail before the usb device of the camera is
+	// reset through sysfs, 0 never resets it
+	RecoverAfter int
+
+	settingsApplied bool
+	// the captures that failed in a row, and the port the camera was last found on with the sysfs name of its usb
+	// device, eg 1-1.3. The device number in the port changes when the device is enumerated again, the name doesn't.
+	failures   int
+	lastPort   string
+	lastDevice string
+	// the model gphoto2 --auto-detect listed on USBPort
+	detectedModel string
+	// when the frames on the card are downloaded and the camera is housekept next, see nextMaintenance
+	nextDownload, nextHousekeeping time.Time
+	// housekeeping state: when the clock was set, what was below its warning and the configs the camera doesn't have
+	clockSynced    time.Time
+	batteryLow     bool
+	storageLow     map[string]bool
+	missingConfigs map[string]bool
 }
 
-//RunWait start the camera on an interval capture
-func (cam *GphotoCamera) RunWait(stop <-chan bool, captureTime chan<- telegraf.Measurement) {
-	waitForNextTimepoint := time.After(time.Until(time.Now().Add(cam.Interval.Duration).Truncate(cam.Interval.Duration)))
+func init() {
+	registerCameraBackend("gphoto", cameraBackend{
+		newCamera: func() Camera {
+			return &GphotoCamera{
+				BracketConfig:    "exposurecompensation",
+				RecoverAfter:     3,
+				DownloadInterval: duration{time.Hour},
+				BatteryWarning:   20,
+				StorageWarning:   10,
+			}
+		},
+	})
+}
 
-	select {
-	case <-stop:
-		return
-	case <-waitForNextTimepoint:
-		break
+//Describe returns a human readable summary of the camera, satisfies Camera
+func (cam *GphotoCamera) Describe() string {
+	return fmt.Sprintf("%s\n\t%s", cam.CameraConfig.describe(), cam.USBPort)
+}
+
+//Health finds the usb port of the camera by its serial number and applies its Settings, satisfies Camera
+func (cam *GphotoCamera) Health(ctx context.Context) error {
+	if err := cam.findPort(ctx); err != nil {
+		return err
+	}
+	if !cam.settingsApplied || cam.SettingsEveryCapture {
+		return cam.applySettings(ctx)
 	}
+	return nil
+}
 
-	ticker := time.NewTicker(cam.Interval.Duration)
-	defer ticker.Stop()
+// findPort checks that the camera is still on its USBPort, only probing every bus with resetUsb if it isn't,
+// so that captures don't need the global lock
+func (cam *GphotoCamera) findPort(ctx context.Context) error {
+	if cam.USBPort != "" {
+		if cam.checkUSBPort(ctx, cam.USBPort) {
+			return nil
+		}
+	}
+	_, err := cam.resetUsb(ctx)
+	return err
+}
 
-	start := time.Now()
-	timestamp := time.Now().Truncate(cam.Interval.Duration).Format(config.TimestampFormat)
-	err := cam.capture(timestamp)
+// usbPort returns the port the camera was found on, satisfies usbDevice
+func (cam *GphotoCamera) usbPort() string {
+	return cam.USBPort
+}
 
-	if err != nil {
-		errLog.Println("error capturing: ", err)
-	} else {
-		m := telegraf.MeasureFloat64("camera", "timing_capture_s", time.Since(start).Seconds())
-		m.AddTag("camera_name", cam.FilenamePrefix)
-		captureTime <- m
-		infoLog.Printf("%s capture took %s\n",cam.FilenamePrefix, time.Since(start))
-	}
-	for {
-		select {
-		case t := <-ticker.C:
-			if cam.Enable {
-				start := time.Now()
-				// Truncate the current time to the interval duration
-				timestamp := t.Truncate(cam.Interval.Duration).Format(config.TimestampFormat)
-				err := cam.capture(timestamp)
-				if err != nil {
-					errLog.Println("error capturing: ", err)
-				} else {
-
-					m := telegraf.MeasureFloat64("camera", "timing_capture_s", time.Since(start).Seconds())
-					m.AddTag("camera_name", cam.FilenamePrefix)
-					captureTime <- m
-					infoLog.Printf("%s capture took %s\n", cam.FilenamePrefix, time.Since(start))
-				}
-			}
-		case <-stop:
-			return
+func (cam *GphotoCamera) validate() (problems []string) {
+	problems = append(problems, cam.validateMatchers()...)
+	if _, exists := cam.Settings["capturetarget"]; exists {
+		problems = append(problems, "capturetarget is set by go-eyepi and can't be one of the settings")
+	}
+	if cam.CaptureToCard && len(cam.DownloadSchedule) == 0 && cam.DownloadInterval.Duration <= 0 {
+		problems = append(problems, "capturetocard needs a downloadinterval or downloadschedule")
+	}
+	if cam.DeleteFromCard && !cam.CaptureToCard {
+		problems = append(problems, "deletefromcard is set, but capturetocard isn't")
+	}
+	if cam.HousekeepingInterval.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("housekeepinginterval is %s, it can't be negative", cam.HousekeepingInterval))
+	}
+	for name, percent := range map[string]int{"batterywarning": cam.BatteryWarning, "storagewarning": cam.StorageWarning} {
+		if percent < 0 || percent > 100 {
+			problems = append(problems, fmt.Sprintf("%s is %d, it is a percentage", name, percent))
 		}
 	}
+	if cam.RecoverAfter < 0 {
+		problems = append(problems, fmt.Sprintf("recoverafter is %d, it can't be negative", cam.RecoverAfter))
+	}
+	return
 }
 
-func (cam *GphotoCamera) capture(timestamp string) error {
+func (cam *GphotoCamera) deviceID() string {
+	if len(cam.matchers()) == 0 {
+		return ""
+	}
+	return "gphoto2 camera with " + cam.describeMatchers()
+}
+
+func (cam *GphotoCamera) capture(ctx context.Context, timestamp string) error {
+	if err := cam.Health(ctx); err != nil {
+		cam.handleCaptureError(ctx, err)
+		return err
+	}
 
-	// the filepath must resolve with %C for cameras that return multiple images (like canons jpg+raw)
-	filePath := filepath.Join(cam.OutputDir, fmt.Sprintf("%s_%s.%%C", cam.FilenamePrefix, timestamp))
-	filePathJpeg := filepath.Join(cam.OutputDir, fmt.Sprintf("%s_%s.jpg", cam.FilenamePrefix, timestamp))
-	lastJpegPath := filepath.Join(cam.OutputDir, fmt.Sprintf("last_image.jpg"))
+	// hold the lock for the whole set so that the frames of a timepoint are taken together
+	unlock, waited := usbLocks.lockBuses(cam.USBPort)
+	cam.lockWait += waited
+	captured := len(cam.files)
+	err := cam.captureFrames(ctx, timestamp, nil)
+	unlock()
+	cam.addFiles(cam.postProcess(cam.files[captured:])...)
+
+	cam.handleCaptureError(ctx, err)
+	if e, ok := err.(gphotoError); ok && e.kind() == modelNotFound && cam.USBPort != "" {
+		// it was found again, maybe on another port, otherwise it is gone until someone plugs it back in
+		return transientError{err}
+	}
+	return err
+}
 
-	_, err := cam.resetUsb()
+// postProcess converts the raw files of a capture with ConvertRaw, satisfies capturePostProcessor.
+// A file that can't be converted is only logged, the capture itself succeeded.
+func (cam *GphotoCamera) postProcess(files []string) (converted []string) {
+	if !cam.ConvertRaw {
+		return nil
+	}
+	for _, file := range files {
+		if !isRawFile(file) {
+			continue
+		}
+		tiffPath := strings.TrimSuffix(file, filepath.Ext(file)) + ".tiff"
+		if err := convertRaw(file, tiffPath); err != nil {
+			warnLog.Printf("%s cannot convert %s: %s\n", cam.FilenamePrefix, filepath.Base(file), err)
+			continue
+		}
+		converted = append(converted, tiffPath)
+	}
+	return
+}
+
+// handleCaptureError recovers from a failed capture: a camera that stopped responding or went away is detected
+// again and one that is out of space is disabled. After RecoverAfter failures in a row its usb device is reset.
+// Retrying is left to captureWithRetries, see isTransient.
+func (cam *GphotoCamera) handleCaptureError(ctx context.Context, err error) {
+	if err == nil {
+		cam.failures = 0
+		return
+	}
+	cam.failures++
+	if cam.RecoverAfter > 0 && cam.failures >= cam.RecoverAfter && ctx.Err() == nil {
+		cam.failures = 0
+		cam.recoverUsb(ctx)
+		return
+	}
+	switch e := err.(type) {
+	case captureTimeoutError:
+		cam.redetect(ctx)
+	case gphotoError:
+		switch e.kind() {
+		case ioProblem, modelNotFound:
+			cam.redetect(ctx)
+		case outOfSpace:
+			errLog.Printf("%s is out of space and disabled until go-eyepi is restarted: %s\n", cam.FilenamePrefix, e)
+			cam.Enable = false
+		}
+	}
+}
+
+// recoverUsb resets the usb device the camera was last found on through sysfs and detects it again
+func (cam *GphotoCamera) recoverUsb(ctx context.Context) {
+	cam.rememberPort()
+	if cam.lastDevice == "" {
+		errLog.Printf("%s failed %d times in a row, but was never found to reset its usb device\n", cam.FilenamePrefix, cam.RecoverAfter)
+		return
+	}
+	warnLog.Printf("%s failed %d times in a row, resetting its usb device %s\n", cam.FilenamePrefix, cam.RecoverAfter, cam.lastDevice)
+	cam.USBPort = ""
+	cam.settingsApplied = false
+	d := sysfsDevice{root: cam.sysfsRoot, name: cam.lastDevice}
+	err := recoverUsbDevice(ctx, d, cam.lastPort, time.Second, usbSettleTime, func() bool {
+		_, err := cam.resetUsb(ctx)
+		return err == nil
+	})
 	if err != nil {
-		return err
+		errLog.Printf("%s: %s\n", cam.FilenamePrefix, err)
+	} else {
+		infoLog.Printf("%s found on %s\n", cam.FilenamePrefix, cam.USBPort)
+	}
+}
+
+// rememberPort keeps the USBPort and the sysfs name of its usb device for when the camera is lost,
+// the name of the last device it was found on is kept if it can't be looked up
+func (cam *GphotoCamera) rememberPort() {
+	if cam.USBPort == "" {
+		return
+	}
+	cam.lastPort = cam.USBPort
+	if d, err := findSysfsDevice(cam.sysfsRoot, cam.USBPort); err == nil {
+		cam.lastDevice = d.name
+	}
+}
+
+// redetect finds the port of a camera that stopped responding again, it may have come back on another one
+func (cam *GphotoCamera) redetect(ctx context.Context) {
+	warnLog.Printf("%s stopped responding on %s, detecting it again\n", cam.FilenamePrefix, cam.USBPort)
+	cam.rememberPort()
+	cam.USBPort = ""
+	// a camera that was reset may have lost its settings
+	cam.settingsApplied = false
+	if port, err := cam.resetUsb(ctx); err != nil {
+		errLog.Printf("%s: %s\n", cam.FilenamePrefix, err)
+	} else {
+		infoLog.Printf("%s found on %s\n", cam.FilenamePrefix, port)
 	}
+}
 
-	infoLog.Printf("capturing %s on %s\n to %s\n",
-		cam.FilenamePrefix,
-		cam.USBPort,
-		filePath)
+// captureFrames captures the frames of a timepoint on the USBPort found by resetUsb, the usb lock must be held.
+// satisfies groupMember
+func (cam *GphotoCamera) captureFrames(ctx context.Context, timestamp string, sync *syncPoint) error {
+	bracket := cam.Bracket
+	if len(bracket) == 0 {
+		bracket = []string{""}
+	}
+	frames := len(bracket) * cam.Burst
+
+	// the jpg of the last frame, or its raw file when the camera only saves raw
+	var lastFrame string
+	for i := 0; i < frames; i++ {
+		name := cam.frameName(timestamp, i, frames)
+		// the filepath must resolve with %C for cameras that return multiple images (like canons jpg+raw)
+		filePath := filepath.Join(cam.OutputDir, name+".%C")
+
+		var settings []string
+		if value := bracket[i/cam.Burst]; value != "" {
+			settings = append(settings, fmt.Sprintf("%s=%s", cam.BracketConfig, value))
+		}
 
-	command := cam.createCaptureCommand(filePath)
+		infoLog.Printf("capturing %s on %s\n to %s %s\n",
+			cam.FilenamePrefix,
+			cam.USBPort,
+			filePath,
+			strings.Join(settings, " "))
 
-	//var outb, errb bytes.Buffer
-	//defer outb.Reset()
-	//defer errb.Reset()
-	//command.Stdout = &outb
-	//command.Stderr = &errb
+		command := cam.createCaptureCommand(ctx, filePath, settings...)
 
-	mutex.Lock()
-	defer mutex.Unlock()
+		var outb, errb bytes.Buffer
+		command.Stdout = &outb
+		command.Stderr = &errb
 
-	err = command.Start()
+		if i == 0 {
+			if err := sync.wait(ctx); err != nil {
+				return err
+			}
+		}
+		err := startProcess(command)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			sync.shutter()
+		}
+
+		if err = gphotoCommandError(cam.waitProcess(ctx, command), errb.String()); err != nil {
+			if _, timedOut := err.(captureTimeoutError); timedOut || ctx.Err() != nil {
+				// gphoto2 was killed, don't leave a partial download behind
+				removeFrame(cam.OutputDir, name)
+			}
+			return err
+		}
+
+		if cam.CaptureToCard {
+			// downloaded later by maintain, under the name of the frame
+			files := parseCardFiles(outb.String())
+			if len(files) == 0 {
+				warnLog.Printf("%s didn't say where %s is on the card, it won't be downloaded\n", cam.FilenamePrefix, name)
+			}
+			if err := cam.recordCardFiles(files, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		files := parseSavedFiles(outb.String())
+		if len(files) == 0 {
+			// gphoto2 didn't say, the jpg is all that can be found without knowing the extensions
+			if _, err := os.Stat(filepath.Join(cam.OutputDir, name+".jpg")); err == nil {
+				files = []string{filepath.Join(cam.OutputDir, name+".jpg")}
+			}
+		}
+		cam.addFiles(files...)
+		if frame := previewFile(files); frame != "" {
+			lastFrame = frame
+		}
+	}
+
+	if lastFrame != "" {
+		if err := cam.timestampLast(lastFrame); err != nil {
+			if isJpeg(lastFrame) {
+				return err
+			}
+			// the capture succeeded, a raw file without a usable preview only means an older last_image.jpg
+			warnLog.Printf("%s last_image.jpg not updated: %s\n", cam.FilenamePrefix, err)
+		}
+	}
+
+	return nil
+}
+
+// timestampLast makes last_image.jpg from the jpg of a frame, or from the preview embedded in its raw file
+func (cam *GphotoCamera) timestampLast(frame string) error {
+	lastJpegPath := filepath.Join(cam.OutputDir, "last_image.jpg")
+	if isJpeg(frame) {
+		return TimestampLast(frame, lastJpegPath)
+	}
+	img, err := rawPreviewImage(frame)
 	if err != nil {
-		//errLog.Println(errb.String())
 		return err
 	}
+	return timestampImage(img, lastJpegPath)
+}
 
-	if err = command.Wait(); err != nil {
-		//errLog.Println(errb.String())
-		return err
+// parseSavedFiles returns the files gphoto2 saved, from the "Saving file as ..." lines it prints
+func parseSavedFiles(output string) (files []string) {
+	for _, m := range savedFileRegexp.FindAllStringSubmatch(output, -1) {
+		files = append(files, m[1])
 	}
+	return
+}
 
-	if _, err := os.Stat(filePathJpeg); !os.IsNotExist(err) {
-		if err = TimestampLast(filePathJpeg, lastJpegPath); err != nil {
-			return err
+func isJpeg(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// previewFile returns the file of a frame that last_image.jpg is made from: its jpg, or else the first other
+// file which is probably raw
+func previewFile(files []string) string {
+	for _, file := range files {
+		if isJpeg(file) {
+			return file
 		}
 	}
+	if len(files) > 0 {
+		return files[0]
+	}
+	return ""
+}
 
-	return nil
+// checkUSBPort tells whether the camera is on port, the model is the one it was detected as
+func (cam *GphotoCamera) checkUSBPort(ctx context.Context, port string) bool {
+	candidate := []detectedCamera{{Model: cam.detectedModel, Port: port}}
+	if cam.usesSysfs() {
+		describeUsbPorts(cam.sysfsRoot, candidate)
+	}
+	if _, err := cam.matchCamera(ctx, candidate); err != nil {
+		return false
+	}
+	cam.USBPort = port
+	return true
 }
 
-func (cam *GphotoCamera) checkUSBPort(port string) (bool, error) {
+// getSerialNumber returns the serial number of the camera on port, or "" if it doesn't report one
+func getSerialNumber(ctx context.Context, port string) (string, error) {
 	usbPortArg := fmt.Sprintf("--port=%s", port)
-	command := exec.Command("gphoto2", "--debug-loglevel=error",
+	command := exec.CommandContext(ctx, "gphoto2", "--debug-loglevel=error",
 		usbPortArg,
 		"--get-config=serialnumber")
-	mutex.Lock()
-	defer mutex.Unlock()
+	var errb bytes.Buffer
+	command.Stderr = &errb
+	unlock, _ := usbLocks.lockBuses(port)
+	defer unlock()
 
 	stdout, err := command.StdoutPipe()
 	if err != nil {
 		errLog.Println("error listing usb ports")
-		return false, err
+		return "", err
 	}
 
 	err = command.Start()
 
 	if err != nil {
 		errLog.Println("error listing usb ports")
-		return false, err
+		return "", err
 	}
 
 	var buf bytes.Buffer
 	defer buf.Reset()
 
 	if _, err = buf.ReadFrom(stdout); err != nil {
-		return false, err
+		return "", err
 	}
 
 	output := buf.Bytes()
 
-	if err := command.Wait(); err != nil {
-		errLog.Println("error checking usb port: ", string(output))
-		return false, err
+	if err := gphotoCommandError(command.Wait(), errb.String()); err != nil {
+		errLog.Println("error checking usb port: ", err)
+		return "", err
 	}
 
-	regexReturn := snRegexp.Find(output)
+	regexReturn := snRegexp.FindSubmatch(output)
 	if regexReturn == nil {
-		return false, nil
+		return "", nil
 	}
-	if strings.Contains(string(regexReturn), cam.GphotoSerialNumber) {
-		cam.USBPort = port
-		return true, nil
-	}
-	return false, nil
+	return string(regexReturn[1]), nil
 }
 
-func (cam *GphotoCamera) getAllUsbPorts() ([]string, error) {
-	command := exec.Command("gphoto2", "--auto-detect")
+// runAutoDetect returns the output of gphoto2 --auto-detect, the list of connected cameras and their ports
+func runAutoDetect(ctx context.Context) ([]byte, error) {
+	command := exec.CommandContext(ctx, "gphoto2", "--auto-detect")
+
+	var errb bytes.Buffer
+	command.Stderr = &errb
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	// probes every bus
+	defer usbLocks.lockAll()()
 
 	stdout, err := command.StdoutPipe()
 	if err != nil {
 		errLog.Println("error listing usb ports")
-		return []string{}, err
+		return nil, err
 	}
 	err = command.Start()
 
 	if err != nil {
 		errLog.Println("error listing usb ports")
-		return []string{}, err
+		return nil, err
 	}
 
 	var buf bytes.Buffer
-	defer buf.Reset()
-
 	if _, err = buf.ReadFrom(stdout); err != nil {
-		return []string{}, err
+		return nil, err
 	}
 	output := buf.Bytes()
 
-	if err := command.Wait(); err != nil {
-		errLog.Println("error listing usb ports: ", string(output))
-		return []string{}, err
+	if err := gphotoCommandError(command.Wait(), errb.String()); err != nil {
+		errLog.Println("error listing usb ports: ", err)
+		return nil, err
 	}
+	return output, nil
+}
 
-	regexReturn := usbRegexp.FindAll(output, -1)
-	if regexReturn == nil {
-		return []string{}, nil
+// resetUsb finds the camera among all the detected cameras and returns its port
+func (cam *GphotoCamera) resetUsb(ctx context.Context) (string, error) {
+	output, err := runAutoDetect(ctx)
+	if err != nil {
+		return "", err
 	}
-
-	rstrings := make([]string, len(regexReturn))
-	for i, usbBytes := range regexReturn {
-		rstrings[i] = string(usbBytes)
+	detected := parseAutoDetect(output)
+	if cam.usesSysfs() {
+		describeUsbPorts(cam.sysfsRoot, detected)
 	}
-
-	return rstrings, nil
-}
-
-func (cam *GphotoCamera) resetUsb() (string, error) {
-	usbPorts, err := cam.getAllUsbPorts()
-
+	d, err := cam.matchCamera(ctx, detected)
 	if err != nil {
 		return "", err
 	}
+	cam.USBPort = d.Port
+	cam.detectedModel = d.Model
+	return d.Port, nil
+}
 
-	for _, port := range usbPorts {
-		valid, err := cam.checkUSBPort(port)
-		if err != nil {
-			errLog.Println("error getting usb port", err)
-		}
-
-		if valid {
-			cam.USBPort = port
-			return port, nil
+// createCaptureCommand returns a gphoto2 command that captures to targetFilename, after applying settings
+// given as "config=value". With CaptureToCard the frame is left on the card instead.
+func (cam *GphotoCamera) createCaptureCommand(ctx context.Context, targetFilename string, settings ...string) *exec.Cmd {
+	if cam.CaptureToCard {
+		args := []string{"--port", cam.USBPort, "--set-config=capturetarget=1"}
+		for _, setting := range settings {
+			args = append(args, fmt.Sprintf("--set-config=%s", setting))
 		}
+		return exec.CommandContext(ctx, "gphoto2", append(args, "--capture-image")...)
 	}
-	return "", fmt.Errorf("Gphoto2 camera with serialnumber %s not detected", cam.GphotoSerialNumber)
-}
-
-func (cam *GphotoCamera) createCaptureCommand(targetFilename string) *exec.Cmd {
 	filenameArg := fmt.Sprintf("--filename=%s", targetFilename)
-	command := exec.Command("gphoto2",
-		"--port", cam.USBPort,
-		"--set-config=capturetarget=0",
+	args := []string{"--port", cam.USBPort, "--set-config=capturetarget=0"}
+	for _, setting := range settings {
+		args = append(args, fmt.Sprintf("--set-config=%s", setting))
+	}
+	args = append(args,
 		"--force-overwrite",
 		"--capture-image-and-download",
 		filenameArg)
 
-	return command
+	return exec.CommandContext(ctx, "gphoto2", args...)
 }
 
 //RunGphoto2Command allows runnning of arbitrary gphoto2 commands
-func (cam *GphotoCamera) RunGphoto2Command(args ...string) (string, error) {
-	valid, err := cam.checkUSBPort(cam.USBPort)
-	if valid && err == nil {
-		usbPort, err := cam.resetUsb()
-		if err != nil {
-			return "", err
-		}
-		cam.USBPort = usbPort
-	}
-	if err != nil {
+func (cam *GphotoCamera) RunGphoto2Command(ctx context.Context, args ...string) (string, error) {
+	if err := cam.findPort(ctx); err != nil {
 		return "", err
 	}
-
-	args = append([]string{"--debug-loglevel=error", "--port", cam.USBPort}, args...)
-	mutex.Lock()
-	command := exec.Command("gphoto2", args...)
-	mutex.Unlock()
-	output, err := command.Output()
-	if err != nil {
-		return string(output), err
-	}
-	return string(output), err
-
+	return cam.gphoto2(ctx, args...)
 }
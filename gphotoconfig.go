@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+//GphotoWidget is a camera config as printed by gphoto2 --get-config and --list-all-config
+type GphotoWidget struct {
+	// Path is where the config is in the tree of the camera, eg /main/imgsettings/iso, only --list-all-config prints it
+	Path  string
+	Label string
+	// Type is one of TEXT, RANGE, TOGGLE, RADIO, MENU, DATE or BUTTON
+	Type     string
+	Readonly bool
+	Current  string
+	// Printable is the human readable Current of DATE configs
+	Printable string
+	// Choices are the values of RADIO and MENU configs
+	Choices []string
+	// Bottom, Top and Step limit the values of RANGE configs
+	Bottom, Top, Step float64
+}
+
+//Name is the name the config is set with, the last part of its Path
+func (w GphotoWidget) Name() string {
+	return path.Base(w.Path)
+}
+
+// parseGphotoConfig parses the output of gphoto2 --get-config (possibly several) or --list-all-config.
+// Every config ends with END, lines that aren't part of one like error messages are skipped.
+func parseGphotoConfig(output string) (widgets []GphotoWidget, err error) {
+	var w GphotoWidget
+	started := false
+	for i, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		key, value := line, ""
+		if colon := strings.Index(line, ": "); colon >= 0 {
+			key, value = line[:colon], line[colon+2:]
+		} else {
+			key = strings.TrimSuffix(key, ":")
+		}
+		switch {
+		case line == "END":
+			widgets = append(widgets, w)
+			w, started = GphotoWidget{}, false
+			continue
+		case strings.HasPrefix(line, "/"):
+			w.Path = line
+		case key == "Label":
+			w.Label = value
+		case key == "Type":
+			w.Type = value
+		case key == "Readonly":
+			w.Readonly = value == "1"
+		case key == "Current":
+			w.Current = value
+		case key == "Printable":
+			w.Printable = value
+		case key == "Choice":
+			// Choice: 3 1/125, the index is followed by the value
+			if space := strings.Index(value, " "); space >= 0 {
+				value = value[space+1:]
+			} else {
+				// an empty choice
+				value = ""
+			}
+			w.Choices = append(w.Choices, value)
+		case key == "Bottom" || key == "Top" || key == "Step":
+			f, parseErr := strconv.ParseFloat(value, 64)
+			if parseErr != nil {
+				return nil, fmt.Errorf("line %d: invalid %s %q", i+1, key, value)
+			}
+			switch key {
+			case "Bottom":
+				w.Bottom = f
+			case "Top":
+				w.Top = f
+			default:
+				w.Step = f
+			}
+		default:
+			continue
+		}
+		started = true
+	}
+	if started {
+		return nil, fmt.Errorf("config %s %s is missing its END", w.Path, w.Label)
+	}
+	return widgets, nil
+}
+
+// accepts returns why the config can't be set to value, or nil if it can
+func (w GphotoWidget) accepts(value string) error {
+	if w.Readonly {
+		return fmt.Errorf("it is read only")
+	}
+	switch w.Type {
+	case "RADIO", "MENU":
+		if len(w.Choices) > 0 && !stringInSlice(value, w.Choices) {
+			return fmt.Errorf("the choices are %q", w.Choices)
+		}
+	case "RANGE":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < w.Bottom || f > w.Top {
+			return fmt.Errorf("it ranges from %g to %g in steps of %g", w.Bottom, w.Top, w.Step)
+		}
+	case "TOGGLE":
+		if _, isToggle := toggleValue(value); !isToggle {
+			return fmt.Errorf("it is a toggle, either 0 or 1")
+		}
+	}
+	return nil
+}
+
+// holds returns whether the current value of the config is value, RANGE and TOGGLE configs are compared by value
+func (w GphotoWidget) holds(value string) bool {
+	switch w.Type {
+	case "RANGE":
+		a, errA := strconv.ParseFloat(w.Current, 64)
+		b, errB := strconv.ParseFloat(value, 64)
+		if errA == nil && errB == nil {
+			return a == b
+		}
+	case "TOGGLE":
+		a, okA := toggleValue(w.Current)
+		b, okB := toggleValue(value)
+		if okA && okB {
+			return a == b
+		}
+	}
+	return w.Current == value
+}
+
+// toggleValue returns the value of a TOGGLE set with any of the words gphoto2 understands
+func toggleValue(value string) (on bool, valid bool) {
+	switch strings.ToLower(value) {
+	case "1", "on", "yes", "true":
+		return true, true
+	case "0", "off", "no", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// describe returns the value of the config and what else it could be set to
+func (w GphotoWidget) describe() string {
+	current := w.Current
+	if w.Printable != "" {
+		current = fmt.Sprintf("%s (%s)", w.Current, w.Printable)
+	}
+	description := fmt.Sprintf("%s = %q\t%s, %s", w.Name(), current, w.Label, w.Type)
+	if w.Readonly {
+		description += ", read only"
+	}
+	switch {
+	case len(w.Choices) > 0:
+		description += fmt.Sprintf("\n\tchoices %q", w.Choices)
+	case w.Type == "RANGE":
+		description += fmt.Sprintf("\n\tfrom %g to %g in steps of %g", w.Bottom, w.Top, w.Step)
+	}
+	return description
+}
+
+//ListConfig returns every config of the camera, from gphoto2 --list-all-config
+func (cam *GphotoCamera) ListConfig(ctx context.Context) ([]GphotoWidget, error) {
+	output, err := cam.RunGphoto2Command(ctx, "--list-all-config")
+	if err != nil {
+		return nil, err
+	}
+	return parseGphotoConfig(output)
+}
+
+//GetConfig returns the configs of the camera called names, in the same order
+func (cam *GphotoCamera) GetConfig(ctx context.Context, names ...string) ([]GphotoWidget, error) {
+	if err := cam.findPort(ctx); err != nil {
+		return nil, err
+	}
+	return cam.getConfig(ctx, names...)
+}
+
+// getConfig is GetConfig on the USBPort already found
+func (cam *GphotoCamera) getConfig(ctx context.Context, names ...string) ([]GphotoWidget, error) {
+	var args []string
+	for _, name := range names {
+		args = append(args, "--get-config", name)
+	}
+	output, err := cam.gphoto2(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	widgets, err := parseGphotoConfig(output)
+	if err != nil {
+		return nil, err
+	}
+	if len(widgets) != len(names) {
+		return nil, fmt.Errorf("expected %d configs from gphoto2 --get-config, got %d", len(names), len(widgets))
+	}
+	// --get-config doesn't print the path, name them as they were asked for
+	for i := range widgets {
+		widgets[i].Path = names[i]
+	}
+	return widgets, nil
+}
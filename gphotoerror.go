@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gphoto2 result codes, from gphoto2-port-result.h and gphoto2-result.h
+const (
+	gpErrorTimeout       = -10
+	gpErrorIO            = -7
+	gpErrorIOUSBFind     = -52
+	gpErrorIOUSBClaim    = -53
+	gpErrorModelNotFound = -105
+	gpErrorCameraBusy    = -110
+	gpErrorNoSpace       = -115
+)
+
+// gphoto2 prints errors as *** Error (-7: 'I/O problem') ***, or without a code when it can't find a camera at all
+var /* const */ gphotoErrorRegexp = regexp.MustCompile(`\*\*\* Error \((-?\d+): '([^']*)'\) \*\*\*`)
+var /* const */ gphotoNoCameraRegexp = regexp.MustCompile(`\*\*\* Error: No camera found\. \*\*\*`)
+
+//gphotoErrorKind is what went wrong in a gphoto2 call, it decides what is done about it
+type gphotoErrorKind string
+
+const (
+	// ioProblem is a broken connection to the camera, its port is reset and the capture retried
+	ioProblem gphotoErrorKind = "io_problem"
+	// cameraBusy is a camera still busy with something else, the capture is retried
+	cameraBusy gphotoErrorKind = "camera_busy"
+	// modelNotFound is no camera (or an unknown one) on the port, it moved or went away and is detected again.
+	// It isn't transient, the capture is only retried if detecting it again finds the camera.
+	modelNotFound gphotoErrorKind = "model_not_found"
+	// outOfSpace is a full card, the camera is disabled until someone empties it
+	outOfSpace gphotoErrorKind = "out_of_space"
+	// otherError is any other gphoto2 error, the capture is retried
+	otherError gphotoErrorKind = "gphoto2_error"
+)
+
+//gphotoError is an error reported by gphoto2 on stderr
+type gphotoError struct {
+	Code    int
+	Message string
+}
+
+func (e gphotoError) Error() string {
+	return fmt.Sprintf("gphoto2 error %d (%s): %s", e.Code, e.kind(), e.Message)
+}
+
+func (e gphotoError) kind() gphotoErrorKind {
+	switch e.Code {
+	case gpErrorIO, gpErrorIOUSBFind, gpErrorIOUSBClaim, gpErrorTimeout:
+		return ioProblem
+	case gpErrorCameraBusy:
+		return cameraBusy
+	case gpErrorModelNotFound:
+		return modelNotFound
+	case gpErrorNoSpace:
+		return outOfSpace
+	}
+	return otherError
+}
+
+// transient is false for errors that another attempt won't fix, a full card or a camera that is gone
+func (e gphotoError) transient() bool {
+	return e.kind() != outOfSpace && e.kind() != modelNotFound
+}
+
+// parseGphotoError returns the last error with a code gphoto2 printed to stderr, the one it gave up on.
+// ok is false if there is none.
+func parseGphotoError(stderr string) (e gphotoError, ok bool) {
+	if matches := gphotoErrorRegexp.FindAllStringSubmatch(stderr, -1); matches != nil {
+		last := matches[len(matches)-1]
+		code, err := strconv.Atoi(last[1])
+		if err == nil {
+			return gphotoError{Code: code, Message: last[2]}, true
+		}
+	}
+	if gphotoNoCameraRegexp.MatchString(stderr) {
+		return gphotoError{Code: gpErrorModelNotFound, Message: "No camera found"}, true
+	}
+	return gphotoError{}, false
+}
+
+// gphotoCommandError turns the error of a gphoto2 command into a gphotoError if its stderr has one,
+// otherwise it adds stderr to the error
+func gphotoCommandError(err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	if _, timedOut := err.(captureTimeoutError); timedOut {
+		return err
+	}
+	if e, ok := parseGphotoError(stderr); ok {
+		return e
+	}
+	if message := strings.TrimSpace(stderr); message != "" {
+		return fmt.Errorf("%s: %s", err, message)
+	}
+	return err
+}
+
+// errorKind returns the kind of a capture error for logs and metrics
+func errorKind(err error) string {
+	switch e := err.(type) {
+	case gphotoError:
+		return string(e.kind())
+	case captureTimeoutError:
+		return "timeout"
+	case permanentError:
+		return "permanent"
+	case transientError:
+		return errorKind(e.error)
+	}
+	return "error"
+}
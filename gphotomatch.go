@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var /* const */ usbIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{4}$`)
+
+//cameraMatcher identifies a GphotoCamera among the detected cameras by one of its settings
+type cameraMatcher struct {
+	// wanted returns the setting of the camera, "" if it isn't set
+	wanted func(cam *GphotoCamera) string
+	// matches tells whether a detected camera has the wanted value
+	matches func(ctx context.Context, d *detectedCamera, wanted string) bool
+}
+
+// cameraMatchers by the name used in the match setting
+var cameraMatchers = map[string]cameraMatcher{
+	"usbpath": {
+		wanted:  func(cam *GphotoCamera) string { return cam.USBPath },
+		matches: func(ctx context.Context, d *detectedCamera, wanted string) bool { return d.USBPath == wanted },
+	},
+	"usbid": {
+		wanted: func(cam *GphotoCamera) string { return cam.USBID },
+		matches: func(ctx context.Context, d *detectedCamera, wanted string) bool {
+			return d.USBID != "" && strings.EqualFold(d.USBID, wanted)
+		},
+	},
+	"model": {
+		wanted: func(cam *GphotoCamera) string { return cam.Model },
+		matches: func(ctx context.Context, d *detectedCamera, wanted string) bool {
+			return d.Model != "" && strings.EqualFold(d.Model, wanted)
+		},
+	},
+	"gphotoserialnumber": {
+		wanted: func(cam *GphotoCamera) string { return cam.GphotoSerialNumber },
+		matches: func(ctx context.Context, d *detectedCamera, wanted string) bool {
+			if !d.serialRead {
+				var err error
+				if d.SerialNumber, err = getSerialNumber(ctx, d.Port); err != nil {
+					errLog.Printf("cannot read the serial number of the camera on %s: %s\n", d.Port, err)
+					return false
+				}
+				d.serialRead = true
+			}
+			return d.SerialNumber != "" && strings.Contains(d.SerialNumber, wanted)
+		},
+	},
+}
+
+// defaultMatchOrder tries the cheap matchers first, serial numbers need a gphoto2 call for every camera
+var defaultMatchOrder = []string{"usbpath", "usbid", "model", "gphotoserialnumber"}
+
+// usesSysfs is true if the camera is matched by its usb device, which is looked up in sysfs
+func (cam *GphotoCamera) usesSysfs() bool {
+	for _, name := range cam.matchers() {
+		if name == "usbpath" || name == "usbid" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchers returns the names of the matchers that identify the camera: the Match setting,
+// or every matcher with a value in the default order
+func (cam *GphotoCamera) matchers() []string {
+	if len(cam.Match) > 0 {
+		return cam.Match
+	}
+	var names []string
+	for _, name := range defaultMatchOrder {
+		if cameraMatchers[name].wanted(cam) != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// describeMatchers returns the matchers of the camera with their values, eg usbpath = "1-1.3", model = "Canon EOS 650D"
+func (cam *GphotoCamera) describeMatchers() string {
+	var described []string
+	for _, name := range cam.matchers() {
+		if m, known := cameraMatchers[name]; known {
+			described = append(described, fmt.Sprintf("%s = %q", name, m.wanted(cam)))
+		}
+	}
+	return strings.Join(described, ", ")
+}
+
+// validateMatchers checks that the camera can be identified, and that the matchers it is identified by are set
+func (cam *GphotoCamera) validateMatchers() (problems []string) {
+	names := cam.matchers()
+	if len(names) == 0 {
+		problems = append(problems, "one of gphotoserialnumber, usbpath, usbid or model is required to find the camera")
+	}
+	for _, name := range names {
+		m, known := cameraMatchers[name]
+		switch {
+		case !known:
+			problems = append(problems, fmt.Sprintf("match %q is unknown, use %s", name, strings.Join(defaultMatchOrder, ", ")))
+		case m.wanted(cam) == "":
+			problems = append(problems, fmt.Sprintf("match has %s, but it isn't set", name))
+		}
+	}
+	if cam.USBID != "" && !usbIDRegexp.MatchString(cam.USBID) {
+		problems = append(problems, fmt.Sprintf("usbid %q isn't a vendor:product id like 04a9:3218", cam.USBID))
+	}
+	return
+}
+
+// matchingCameras narrows the detected cameras down with every matcher in turn and returns the ones left
+func (cam *GphotoCamera) matchingCameras(ctx context.Context, detected []detectedCamera) []detectedCamera {
+	candidates := detected
+	for _, name := range cam.matchers() {
+		m := cameraMatchers[name]
+		var matched []detectedCamera
+		for i := range candidates {
+			if m.matches(ctx, &candidates[i], m.wanted(cam)) {
+				matched = append(matched, candidates[i])
+			}
+		}
+		candidates = matched
+		if len(candidates) == 0 {
+			break
+		}
+	}
+	return candidates
+}
+
+// matchCamera returns the detected camera that is cam, it fails unless exactly one of them matches
+func (cam *GphotoCamera) matchCamera(ctx context.Context, detected []detectedCamera) (detectedCamera, error) {
+	candidates := cam.matchingCameras(ctx, detected)
+	switch len(candidates) {
+	case 1:
+		return candidates[0], nil
+	case 0:
+		return detectedCamera{}, permanentError{fmt.Errorf("no gphoto2 camera with %s detected", cam.describeMatchers())}
+	}
+	var found []string
+	for _, d := range candidates {
+		found = append(found, d.describe())
+	}
+	return detectedCamera{}, permanentError{fmt.Errorf("%s is ambiguous, it matches %d cameras: %s",
+		cam.describeMatchers(), len(candidates), strings.Join(found, "; "))}
+}
+
+// describe returns the model, port and whatever else is known about a detected camera
+func (d detectedCamera) describe() string {
+	s := fmt.Sprintf("%s on %s", d.Model, d.Port)
+	if d.USBPath != "" {
+		s += fmt.Sprintf(" (usbpath %s, usbid %s)", d.USBPath, d.USBID)
+	}
+	if d.SerialNumber != "" {
+		s += " serial number " + d.SerialNumber
+	}
+	return s
+}
+
+// describeUsbPorts fills in the USBPath and USBID of the detected cameras from their usb devices in
+// /sys/bus/usb/devices under root. Only the device of every port is read, sysfs isn't walked.
+func describeUsbPorts(root string, cameras []detectedCamera) {
+	for i := range cameras {
+		d, err := findSysfsDevice(root, cameras[i].Port)
+		if err != nil {
+			continue
+		}
+		env, err := getEventFromUEventFile(d.path("uevent"))
+		if err != nil {
+			warnLog.Printf("cannot read the usb device of %s: %s\n", cameras[i].Port, err)
+			continue
+		}
+		cameras[i].USBPath = d.name
+		cameras[i].USBID = usbID(env["PRODUCT"])
+	}
+}
+
+// usbID returns the vendor:product id of a uevent PRODUCT like 4a9/3218/2, eg 04a9:3218
+func usbID(product string) string {
+	fields := strings.Split(product, "/")
+	if len(fields) < 2 {
+		return ""
+	}
+	vendor, err := strconv.ParseUint(fields[0], 16, 16)
+	if err != nil {
+		return ""
+	}
+	id, err := strconv.ParseUint(fields[1], 16, 16)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%04x:%04x", vendor, id)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// settingNames returns the names of the Settings in order, so that they are applied the same way every time
+func (cam *GphotoCamera) settingNames() []string {
+	names := make([]string, 0, len(cam.Settings))
+	for name := range cam.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gphoto2 runs gphoto2 with args on the USBPort of the camera, holding the lock of its bus.
+// Errors are parsed from what gphoto2 printed to stderr, see gphotoCommandError.
+func (cam *GphotoCamera) gphoto2(ctx context.Context, args ...string) (string, error) {
+	args = append([]string{"--debug-loglevel=error", "--port", cam.USBPort}, args...)
+	command := exec.CommandContext(ctx, "gphoto2", args...)
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	unlock, _ := usbLocks.lockBuses(cam.USBPort)
+	defer unlock()
+	if err := startProcess(command); err != nil {
+		return "", err
+	}
+	err := gphotoCommandError(cam.waitProcess(ctx, command), stderr.String())
+	return stdout.String(), err
+}
+
+// getSettings reads the current value and choices of the Settings from the camera
+func (cam *GphotoCamera) getSettings(ctx context.Context) (map[string]GphotoWidget, error) {
+	names := cam.settingNames()
+	widgets, err := cam.getConfig(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]GphotoWidget)
+	for i, name := range names {
+		current[name] = widgets[i]
+	}
+	return current, nil
+}
+
+// applySettings sets the Settings on the camera and reads them back to check that the camera took them.
+// Values that aren't among the choices of a setting are rejected before anything is set.
+func (cam *GphotoCamera) applySettings(ctx context.Context) error {
+	if len(cam.Settings) == 0 {
+		return nil
+	}
+	widgets, err := cam.getSettings(ctx)
+	if err != nil {
+		return fmt.Errorf("reading the settings of %s: %s", cam.FilenamePrefix, err)
+	}
+	var args []string
+	for _, name := range cam.settingNames() {
+		value := cam.Settings[name]
+		if err := widgets[name].accepts(value); err != nil {
+			return permanentError{fmt.Errorf("%s does not accept %s = %q, %s", cam.FilenamePrefix, name, value, err)}
+		}
+		args = append(args, fmt.Sprintf("--set-config=%s=%s", name, value))
+	}
+	if _, err := cam.gphoto2(ctx, args...); err != nil {
+		return fmt.Errorf("applying the settings of %s: %s", cam.FilenamePrefix, err)
+	}
+
+	if widgets, err = cam.getSettings(ctx); err != nil {
+		return fmt.Errorf("reading back the settings of %s: %s", cam.FilenamePrefix, err)
+	}
+	var rejected []string
+	for _, name := range cam.settingNames() {
+		if value := cam.Settings[name]; !widgets[name].holds(value) {
+			rejected = append(rejected, fmt.Sprintf("%s = %q (the camera kept %q)", name, value, widgets[name].Current))
+		}
+	}
+	if len(rejected) > 0 {
+		return permanentError{fmt.Errorf("%s did not take %s", cam.FilenamePrefix, strings.Join(rejected, ", "))}
+	}
+	cam.settingsApplied = true
+	infoLog.Printf("%s settings applied\n", cam.FilenamePrefix)
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mdaffin/go-telegraf"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//CameraGroup captures its member cameras together, triggered at a barrier so that their images of a timepoint are
+//taken as close together as possible and named with the same timestamp.
+//The group replaces the schedule of its members, which aren't run on their own.
+//
+//Members can't take their bus locks one after the other like separate cameras do, that would serialise the members
+//sharing a bus again. Instead the group finds the ports of its members first and then holds the locks of all their
+//buses while they capture in parallel, so that nothing else runs gphoto2 on those buses in the meantime.
+type CameraGroup struct {
+	CameraConfig
+	// Cameras are the names of the members
+	Cameras []string
+
+	name    string
+	members []groupMember
+	// the members that captured the timepoint being retried, so that a retry only repeats the failed ones
+	retrying  string
+	succeeded map[string]bool
+	// spread is the time between the first and the last member triggered in the last capture
+	spread time.Duration
+}
+
+//groupMember is implemented by camera types that can capture as part of a CameraGroup
+type groupMember interface {
+	Camera
+	// captureFrames captures the frames of a timepoint without finding the port of the camera or taking the usb lock,
+	// the group has done both. It waits at sync just before triggering the first frame.
+	captureFrames(ctx context.Context, timestamp string, sync *syncPoint) error
+}
+
+//usbDevice is implemented by camera types on a USB port, whose bus must be locked while they capture
+type usbDevice interface {
+	usbPort() string
+}
+
+//capturePostProcessor is implemented by camera types that process the files of a capture after it, without holding
+//the usb lock. It returns the files it wrote.
+type capturePostProcessor interface {
+	postProcess(files []string) []string
+}
+
+//captureErrorHandler is implemented by camera types that recover from capture errors, eg by finding a camera again
+//after it stopped responding. It is called with nil after a capture that succeeded.
+type captureErrorHandler interface {
+	handleCaptureError(ctx context.Context, err error)
+}
+
+func init() {
+	registerCameraBackend("group", cameraBackend{
+		newCamera: func() Camera {
+			return &CameraGroup{CameraConfig: CameraConfig{Enable: true}}
+		},
+	})
+}
+
+//Describe returns a human readable summary of the group, satisfies Camera
+func (g *CameraGroup) Describe() string {
+	return fmt.Sprintf("%s\n\tgroup of %s", g.CameraConfig.describe(), strings.Join(g.Cameras, ", "))
+}
+
+//Health checks the enabled members, the group can capture if any of them can, satisfies Camera
+func (g *CameraGroup) Health(ctx context.Context) error {
+	ready, unavailable := g.ready(ctx)
+	if len(ready) == 0 {
+		return fmt.Errorf("no member of %s is able to capture: %s", g.name, strings.Join(unavailable, ", "))
+	}
+	return nil
+}
+
+// ready returns the enabled members that are able to capture and why the others aren't
+func (g *CameraGroup) ready(ctx context.Context) (ready []groupMember, unavailable []string) {
+	for _, member := range g.members {
+		if !member.Config().Enable {
+			continue
+		}
+		err := member.Health(ctx)
+		if err == nil {
+			err = os.MkdirAll(member.Config().OutputDir, 0777)
+		}
+		if err != nil {
+			unavailable = append(unavailable, fmt.Sprintf("%s: %s", member.Config().FilenamePrefix, err))
+			if h, ok := member.(captureErrorHandler); ok {
+				h.handleCaptureError(ctx, err)
+			}
+			continue
+		}
+		ready = append(ready, member)
+	}
+	return
+}
+
+// capture triggers the members together with the same timestamp. It fails if any member failed,
+// retries of the same timestamp only capture the members that failed.
+func (g *CameraGroup) capture(ctx context.Context, timestamp string) error {
+	if g.retrying != timestamp {
+		g.retrying = timestamp
+		g.succeeded = make(map[string]bool)
+	}
+	ready, failed := g.ready(ctx)
+	if len(ready) == 0 {
+		return fmt.Errorf("no member of %s is able to capture: %s", g.name, strings.Join(failed, ", "))
+	}
+
+	// lock the buses of the members that capture, the ports were found by ready
+	var ports []string
+	for _, member := range ready {
+		if d, ok := member.(usbDevice); ok && !g.succeeded[member.Config().FilenamePrefix] {
+			ports = append(ports, d.usbPort())
+		}
+	}
+	unlock, waited := usbLocks.lockBuses(ports...)
+	g.lockWait += waited
+
+	// every member joins before any of them starts, so that the first to arrive doesn't find itself alone
+	b := &barrier{release: make(chan struct{})}
+	points := make([]*syncPoint, len(ready))
+	for i, member := range ready {
+		if !g.succeeded[member.Config().FilenamePrefix] {
+			points[i] = b.join()
+		}
+	}
+	errs := make([]error, len(ready))
+	var wg sync.WaitGroup
+	for i, member := range ready {
+		if points[i] == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, member groupMember) {
+			defer wg.Done()
+			// a member that failed before the barrier must not hold up the others
+			defer points[i].leave()
+			errs[i] = member.captureFrames(ctx, timestamp, points[i])
+		}(i, member)
+	}
+	wg.Wait()
+	unlock()
+	// the timeouts of the members are counted as the group's, RunWait takes them with its own
+	for _, member := range g.members {
+		g.timeouts += member.Config().takeTimeouts()
+	}
+
+	g.spread = b.spread()
+	infoLog.Printf("%s triggered %d members within %s\n", g.name, len(b.shutters), g.spread)
+
+	for i, member := range ready {
+		if points[i] == nil {
+			continue
+		}
+		prefix := member.Config().FilenamePrefix
+		// the files of the members are those of the group
+		files := member.Config().takeFiles()
+		if p, ok := member.(capturePostProcessor); ok {
+			files = append(files, p.postProcess(files)...)
+		}
+		g.addFiles(files...)
+		if h, ok := member.(captureErrorHandler); ok {
+			h.handleCaptureError(ctx, errs[i])
+		}
+		if errs[i] != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", prefix, errs[i]))
+		} else {
+			g.succeeded[prefix] = true
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s capture failed for %s", g.name, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// report adds the spread of the last capture to its measurement, satisfies captureReporter
+func (g *CameraGroup) report(m *telegraf.Measurement) {
+	*m = m.AddFloat64("group_spread_s", g.spread.Seconds())
+}
+
+// nextMaintenance returns when the first of the members is due for maintenance, satisfies cameraMaintainer
+func (g *CameraGroup) nextMaintenance(now time.Time) time.Time {
+	var next time.Time
+	for _, member := range g.members {
+		m, ok := member.(cameraMaintainer)
+		if !ok || !member.Config().Enable {
+			continue
+		}
+		if n := m.nextMaintenance(now); !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
+
+// maintain runs the maintenance of the members that are due, the group runs them as they aren't run on their own.
+// satisfies cameraMaintainer
+func (g *CameraGroup) maintain(ctx context.Context, measurements chan<- telegraf.Measurement) {
+	now := time.Now()
+	for _, member := range g.members {
+		m, ok := member.(cameraMaintainer)
+		if !ok || !member.Config().Enable {
+			continue
+		}
+		if n := m.nextMaintenance(now); !n.IsZero() && !n.After(now) {
+			m.maintain(ctx, measurements)
+		}
+	}
+}
+
+// linkGroups resolves the members of every group of c. Members are taken out of the schedule,
+// a change to any of them restarts the group.
+func linkGroups(c *GlobalConfig) (problems configProblems) {
+	c.Groups = make(map[string]*CameraGroup)
+	grouped := make(map[string]string)
+	for name, cam := range c.Cameras {
+		if g, isGroup := cam.(*CameraGroup); isGroup {
+			g.name = name
+			c.Groups[name] = g
+		}
+	}
+	for _, name := range sortedCameras(c) {
+		g, isGroup := c.Cameras[name].(*CameraGroup)
+		if !isGroup {
+			continue
+		}
+		if len(g.Cameras) == 0 {
+			problems.add("%s: a group needs cameras", name)
+		}
+		for _, memberName := range g.Cameras {
+			cam, exists := c.Cameras[memberName]
+			member, canGroup := cam.(groupMember)
+			_, isGroup := cam.(*CameraGroup)
+			switch {
+			case !exists:
+				problems.add("%s: there is no camera called %s", name, memberName)
+				continue
+			case isGroup || !canGroup:
+				problems.add("%s: %s can't be a member of a group", name, memberName)
+				continue
+			case grouped[memberName] != "":
+				problems.add("%s: %s is already a member of %s", name, memberName, grouped[memberName])
+				continue
+			}
+			grouped[memberName] = name
+			member.Config().group = name
+			g.members = append(g.members, member)
+			g.loadedFrom = append(g.loadedFrom, member.Config().loadedFrom...)
+		}
+	}
+	return
+}
+
+//barrier holds the members of a group capture back until every one of them is ready to trigger
+type barrier struct {
+	mu sync.Mutex
+	// parties is the number of members still taking part, arrived the number of them waiting
+	parties, arrived int
+	release          chan struct{}
+	shutters         []time.Time
+}
+
+//syncPoint is the place of one member at a barrier, a nil syncPoint doesn't wait so that cameras
+//capturing on their own can share the code
+type syncPoint struct {
+	b       *barrier
+	arrived bool
+}
+
+// join adds a member to the barrier, it must be called for every member before any of them waits
+func (b *barrier) join() *syncPoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.parties++
+	return &syncPoint{b: b}
+}
+
+// releaseIfReady opens the barrier once every remaining member arrived, b.mu must be held
+func (b *barrier) releaseIfReady() {
+	select {
+	case <-b.release:
+		return
+	default:
+	}
+	if b.arrived == b.parties {
+		close(b.release)
+	}
+}
+
+// wait blocks until every member arrived at the barrier or ctx is cancelled
+func (p *syncPoint) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.b.mu.Lock()
+	p.arrived = true
+	p.b.arrived++
+	p.b.releaseIfReady()
+	p.b.mu.Unlock()
+
+	select {
+	case <-p.b.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leave takes a member that didn't arrive out of the barrier, so that the others don't wait for it
+func (p *syncPoint) leave() {
+	if p == nil || p.arrived {
+		return
+	}
+	p.b.mu.Lock()
+	defer p.b.mu.Unlock()
+	p.b.parties--
+	p.b.releaseIfReady()
+}
+
+// shutter records that the member triggered its first frame
+func (p *syncPoint) shutter() {
+	if p == nil {
+		return
+	}
+	p.b.mu.Lock()
+	defer p.b.mu.Unlock()
+	p.b.shutters = append(p.b.shutters, time.Now())
+}
+
+// spread returns the time between the first and the last member triggered
+func (b *barrier) spread() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.shutters) == 0 {
+		return 0
+	}
+	first, last := b.shutters[0], b.shutters[0]
+	for _, t := range b.shutters {
+		if t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last.Sub(first)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mdaffin/go-telegraf"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how often the clock of a camera is set, see SyncClock
+const clockSyncInterval = 24 * time.Hour
+
+var /* const */ storageSectionRegexp = regexp.MustCompile(`^\[Storage \d+\]$`)
+
+//storageInfo is a storage of a camera, usually its card, as printed by gphoto2 --storage-info
+type storageInfo struct {
+	BaseDir, Label string
+	// TotalKB and FreeKB are -1 and FreeImages is -1 when the camera doesn't report them
+	TotalKB, FreeKB int64
+	FreeImages      int
+}
+
+// freePercent returns the free space in percent of the total, ok is false if the camera doesn't report both
+func (s storageInfo) freePercent() (percent int, ok bool) {
+	if s.TotalKB <= 0 || s.FreeKB < 0 {
+		return 0, false
+	}
+	return int(s.FreeKB * 100 / s.TotalKB), true
+}
+
+// parseStorageInfo parses the output of gphoto2 --storage-info, a [Storage N] section of key=value lines for
+// every storage
+func parseStorageInfo(output string) (storages []storageInfo) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if storageSectionRegexp.MatchString(line) {
+			storages = append(storages, storageInfo{TotalKB: -1, FreeKB: -1, FreeImages: -1})
+			continue
+		}
+		equals := strings.Index(line, "=")
+		if equals < 0 || len(storages) == 0 {
+			continue
+		}
+		s := &storages[len(storages)-1]
+		key, value := line[:equals], line[equals+1:]
+		switch key {
+		case "basedir":
+			s.BaseDir = value
+		case "label":
+			s.Label = value
+		case "totalcapacity", "free":
+			// eg 15548672 KB
+			kb, err := strconv.ParseInt(strings.TrimSuffix(value, " KB"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if key == "free" {
+				s.FreeKB = kb
+			} else {
+				s.TotalKB = kb
+			}
+		case "freeimages":
+			if n, err := strconv.Atoi(value); err == nil {
+				s.FreeImages = n
+			}
+		}
+	}
+	return
+}
+
+// parseBatteryLevel returns the battery level in percent from the batterylevel config, eg "75%" or "100".
+// Cameras that only say Full, Half or Low don't have one.
+func parseBatteryLevel(value string) (percent int, ok bool) {
+	percent, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "%")))
+	return percent, err == nil
+}
+
+// nextMaintenance returns when the frames on the card are downloaded or the camera is housekept next,
+// satisfies cameraMaintainer
+func (cam *GphotoCamera) nextMaintenance(now time.Time) time.Time {
+	// kept until the work is done, so that captures running over it don't skip it
+	if cam.CaptureToCard && cam.nextDownload.IsZero() {
+		cam.nextDownload = nextScheduled(now, cam.DownloadInterval.Duration, cam.DownloadSchedule)
+	}
+	if cam.HousekeepingInterval.Duration > 0 && cam.nextHousekeeping.IsZero() {
+		cam.nextHousekeeping = nextScheduled(now, cam.HousekeepingInterval.Duration, nil)
+	}
+	next := cam.nextDownload
+	if next.IsZero() || (!cam.nextHousekeeping.IsZero() && cam.nextHousekeeping.Before(next)) {
+		next = cam.nextHousekeeping
+	}
+	return next
+}
+
+// maintain downloads the frames on the card and housekeeps the camera when they are due, satisfies cameraMaintainer
+func (cam *GphotoCamera) maintain(ctx context.Context, measurements chan<- telegraf.Measurement) {
+	now := time.Now()
+	if !cam.nextDownload.IsZero() && !cam.nextDownload.After(now) {
+		cam.nextDownload = time.Time{}
+		cam.download(ctx, measurements)
+	}
+	if !cam.nextHousekeeping.IsZero() && !cam.nextHousekeeping.After(now) {
+		cam.nextHousekeeping = time.Time{}
+		cam.housekeep(ctx, measurements)
+	}
+}
+
+// housekeep measures the battery level and free space of the camera, warning when they fall below BatteryWarning
+// and StorageWarning, and sets its clock once a day with SyncClock. None of it counts as a failed capture.
+func (cam *GphotoCamera) housekeep(ctx context.Context, measurements chan<- telegraf.Measurement) {
+	if err := cam.findPort(ctx); err != nil {
+		warnLog.Printf("%s housekeeping skipped: %s\n", cam.FilenamePrefix, err)
+		return
+	}
+
+	m := telegraf.NewMeasurement("camera")
+	measured := false
+	if w, found, err := cam.readConfig(ctx, "batterylevel"); err != nil {
+		warnLog.Printf("%s cannot read the battery level: %s\n", cam.FilenamePrefix, err)
+	} else if level, ok := parseBatteryLevel(w.Current); found && ok {
+		m.AddInt("battery_percent", level)
+		measured = true
+		low := level <= cam.BatteryWarning
+		switch {
+		case low && !cam.batteryLow:
+			warnLog.Printf("%s battery is down to %d%%\n", cam.FilenamePrefix, level)
+		case !low && cam.batteryLow:
+			infoLog.Printf("%s battery is back at %d%%\n", cam.FilenamePrefix, level)
+		}
+		cam.batteryLow = low
+	}
+
+	if cam.SyncClock && time.Since(cam.clockSynced) >= clockSyncInterval {
+		if offset, synced, err := cam.syncClock(ctx); err != nil {
+			warnLog.Printf("%s cannot set its clock: %s\n", cam.FilenamePrefix, err)
+		} else if synced {
+			m.AddFloat64("clock_offset_s", offset.Seconds())
+			measured = true
+		}
+	}
+	if measured {
+		m.AddTag("camera_name", cam.FilenamePrefix)
+		measurements <- m
+	}
+
+	output, err := cam.gphoto2(ctx, "--storage-info")
+	if err != nil {
+		warnLog.Printf("%s cannot read its storage info: %s\n", cam.FilenamePrefix, err)
+		return
+	}
+	if cam.storageLow == nil {
+		cam.storageLow = make(map[string]bool)
+	}
+	for _, s := range parseStorageInfo(output) {
+		m := telegraf.NewMeasurement("camera_storage")
+		if s.TotalKB >= 0 {
+			m.AddInt64("total_bytes", s.TotalKB*1024)
+		}
+		if s.FreeKB >= 0 {
+			m.AddInt64("free_bytes", s.FreeKB*1024)
+		}
+		if s.FreeImages >= 0 {
+			m.AddInt("free_images", s.FreeImages)
+		}
+		percent, ok := s.freePercent()
+		if ok {
+			m.AddInt("free_percent", percent)
+		}
+		if s.TotalKB < 0 && s.FreeKB < 0 && s.FreeImages < 0 {
+			continue
+		}
+		m.AddTag("storage", s.BaseDir)
+		m.AddTag("camera_name", cam.FilenamePrefix)
+		measurements <- m
+		if !ok {
+			continue
+		}
+
+		low := percent < cam.StorageWarning
+		switch {
+		case low && !cam.storageLow[s.BaseDir]:
+			warnLog.Printf("%s %s is down to %d%% free (%d MB, %d images)\n",
+				cam.FilenamePrefix, s.BaseDir, percent, s.FreeKB/1024, s.FreeImages)
+		case !low && cam.storageLow[s.BaseDir]:
+			infoLog.Printf("%s %s is back at %d%% free\n", cam.FilenamePrefix, s.BaseDir, percent)
+		}
+		cam.storageLow[s.BaseDir] = low
+	}
+}
+
+// syncClock sets the clock of the camera to the one of the computer and returns how far off it was,
+// synced is false for a camera without a clock
+func (cam *GphotoCamera) syncClock(ctx context.Context) (offset time.Duration, synced bool, err error) {
+	w, found, err := cam.readConfig(ctx, "datetime")
+	if err != nil || !found {
+		return 0, false, err
+	}
+	now := time.Now()
+	// the DATE config is a unix timestamp
+	if seconds, err := strconv.ParseInt(w.Current, 10, 64); err == nil {
+		offset = time.Unix(seconds, 0).Sub(now).Round(time.Second)
+	}
+	if _, err := cam.gphoto2(ctx, "--set-config", "datetime=now"); err != nil {
+		return 0, false, err
+	}
+	cam.clockSynced = now
+	infoLog.Printf("%s clock set, it was %s off\n", cam.FilenamePrefix, offset)
+	return offset, true, nil
+}
+
+// readConfig reads a config that not every camera has, found is false for a camera without it.
+// Such a camera isn't asked again.
+func (cam *GphotoCamera) readConfig(ctx context.Context, name string) (w GphotoWidget, found bool, err error) {
+	if cam.missingConfigs[name] {
+		return w, false, nil
+	}
+	widgets, err := cam.getConfig(ctx, name)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found in configuration tree") {
+			if cam.missingConfigs == nil {
+				cam.missingConfigs = make(map[string]bool)
+			}
+			cam.missingConfigs[name] = true
+			infoLog.Printf("%s has no %s config\n", cam.FilenamePrefix, name)
+			return w, false, nil
+		}
+		return w, false, fmt.Errorf("%s: %s", name, err)
+	}
+	return widgets[0], true, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+//losslessJPEG is a decoded lossless JPEG (ITU T.81 process 14, SOF3), the compression of the raw data in CR2
+//and DNG files
+type losslessJPEG struct {
+	// width and height in samples, every sample has a value for each component
+	width, height, components int
+	precision                 int
+	// data holds the samples row by row with their components next to each other
+	data []uint16
+}
+
+//huffmanTable decodes the difference categories of a lossless JPEG, see T.81 F.2.2.3
+type huffmanTable struct {
+	minCode, maxCode, valPtr [17]int32
+	values                   []byte
+}
+
+func newHuffmanTable(counts []byte, values []byte) huffmanTable {
+	var h huffmanTable
+	h.values = values
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		h.maxCode[l] = -1
+		if n := int32(counts[l-1]); n > 0 {
+			h.valPtr[l] = k
+			h.minCode[l] = code
+			code += n
+			k += n
+			h.maxCode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return h
+}
+
+//jpegBitReader reads the entropy coded data of a scan, removing the stuffed zero bytes.
+//At a marker it reads zeros and leaves the marker to reset.
+type jpegBitReader struct {
+	data []byte
+	pos  int
+	acc  uint32
+	n    uint
+}
+
+func (b *jpegBitReader) fill() {
+	for b.n <= 24 {
+		var c byte
+		if b.pos < len(b.data) {
+			c = b.data[b.pos]
+			switch {
+			case c != 0xff:
+				b.pos++
+			case b.pos+1 < len(b.data) && b.data[b.pos+1] == 0:
+				b.pos += 2
+			default:
+				c = 0
+			}
+		}
+		b.acc |= uint32(c) << (24 - b.n)
+		b.n += 8
+	}
+}
+
+func (b *jpegBitReader) bits(n uint) int32 {
+	if n == 0 {
+		return 0
+	}
+	if b.n < n {
+		b.fill()
+	}
+	v := int32(b.acc >> (32 - n))
+	b.acc <<= n
+	b.n -= n
+	return v
+}
+
+// reset drops the bits left before a restart marker and skips the marker
+func (b *jpegBitReader) reset() error {
+	b.acc, b.n = 0, 0
+	if b.pos+1 >= len(b.data) || b.data[b.pos] != 0xff || b.data[b.pos+1] < 0xd0 || b.data[b.pos+1] > 0xd7 {
+		return fmt.Errorf("lossless jpeg restart marker missing")
+	}
+	b.pos += 2
+	return nil
+}
+
+// diff decodes the next difference to the prediction, T.81 H.1.2.2
+func (b *jpegBitReader) diff(h *huffmanTable) (int32, error) {
+	code := b.bits(1)
+	l := 1
+	for ; l <= 16 && code > h.maxCode[l]; l++ {
+		code = code<<1 | b.bits(1)
+	}
+	if l > 16 || int(h.valPtr[l]+code-h.minCode[l]) >= len(h.values) {
+		return 0, fmt.Errorf("invalid lossless jpeg huffman code")
+	}
+	s := uint(h.values[h.valPtr[l]+code-h.minCode[l]])
+	switch {
+	case s == 0:
+		return 0, nil
+	case s >= 16:
+		return 32768, nil
+	}
+	v := b.bits(s)
+	if v < 1<<(s-1) {
+		v -= 1<<s - 1
+	}
+	return v, nil
+}
+
+// decodeLosslessJPEG decodes a lossless JPEG with a single scan, like the ones in CR2 and DNG files
+func decodeLosslessJPEG(data []byte) (*losslessJPEG, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+	var (
+		j        losslessJPEG
+		tables   [4]huffmanTable
+		ids      []byte
+		restart  int
+		haveSOF3 bool
+	)
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return nil, fmt.Errorf("lossless jpeg marker expected at %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// fill byte
+			pos++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, fmt.Errorf("lossless jpeg segment %x is truncated", marker)
+		}
+		segment := data[pos+4 : pos+2+length]
+		pos += 2 + length
+
+		switch marker {
+		case 0xc4: // DHT
+			for len(segment) >= 17 {
+				class, index := segment[0]>>4, segment[0]&15
+				total := 0
+				for _, n := range segment[1:17] {
+					total += int(n)
+				}
+				if class != 0 || index > 3 || len(segment) < 17+total {
+					return nil, fmt.Errorf("invalid lossless jpeg huffman table")
+				}
+				tables[index] = newHuffmanTable(segment[1:17], segment[17:17+total])
+				segment = segment[17+total:]
+			}
+		case 0xc3: // SOF3
+			if len(segment) < 6 {
+				return nil, fmt.Errorf("lossless jpeg frame header is truncated")
+			}
+			j.precision = int(segment[0])
+			j.height = int(binary.BigEndian.Uint16(segment[1:]))
+			j.width = int(binary.BigEndian.Uint16(segment[3:]))
+			j.components = int(segment[5])
+			if j.components < 1 || j.components > 4 || len(segment) < 6+3*j.components ||
+				j.precision < 2 || j.precision > 16 {
+				return nil, fmt.Errorf("invalid lossless jpeg frame header")
+			}
+			for c := 0; c < j.components; c++ {
+				ids = append(ids, segment[6+3*c])
+				if sampling := segment[7+3*c]; sampling != 0x11 {
+					return nil, fmt.Errorf("subsampled lossless jpeg (like sRAW) isn't supported")
+				}
+			}
+			haveSOF3 = true
+		case 0xc0, 0xc1, 0xc2, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf:
+			return nil, fmt.Errorf("not a lossless jpeg (SOF%d)", marker-0xc0)
+		case 0xdd: // DRI
+			if len(segment) >= 2 {
+				restart = int(binary.BigEndian.Uint16(segment))
+			}
+		case 0xda: // SOS
+			if !haveSOF3 {
+				return nil, fmt.Errorf("lossless jpeg scan before its frame header")
+			}
+			if len(segment) < 1+2*j.components+3 || int(segment[0]) != j.components {
+				return nil, fmt.Errorf("lossless jpeg scans of single components aren't supported")
+			}
+			selected := make([]*huffmanTable, j.components)
+			for c := 0; c < j.components; c++ {
+				if segment[1+2*c] != ids[c] {
+					return nil, fmt.Errorf("lossless jpeg scan components out of order")
+				}
+				selected[c] = &tables[segment[2+2*c]>>4&3]
+			}
+			predictor := int(segment[1+2*j.components])
+			transform := uint(segment[3+2*j.components] & 15)
+			if predictor < 1 || predictor > 7 || int(transform) >= j.precision {
+				return nil, fmt.Errorf("invalid lossless jpeg predictor %d or point transform %d", predictor, transform)
+			}
+			err := j.decodeScan(&jpegBitReader{data: data[pos:]}, selected, predictor, transform, restart)
+			return &j, err
+		case 0xd9: // EOI
+			return nil, fmt.Errorf("lossless jpeg without a scan")
+		}
+	}
+	return nil, fmt.Errorf("lossless jpeg is truncated")
+}
+
+// decodeScan decodes the differences of every sample and adds them to their prediction, T.81 H.1.2.1
+func (j *losslessJPEG) decodeScan(b *jpegBitReader, tables []*huffmanTable, predictor int, transform uint, restart int) error {
+	n := j.components
+	stride := j.width * n
+	// every sample has a huffman code of a bit at least, a frame header claiming more is corrupt
+	if int64(stride)*int64(j.height) > int64(len(b.data))*8 {
+		return fmt.Errorf("lossless jpeg of %dx%dx%d is larger than its %d bytes of data", j.width, j.height, n, len(b.data))
+	}
+	j.data = make([]uint16, stride*j.height)
+	initial := int32(1) << (uint(j.precision) - transform - 1)
+	mask := int32(1)<<(uint(j.precision)-transform) - 1
+
+	// the first sample of the scan, and after every restart, is predicted from initial and its line from the left
+	firstX, firstY := 0, 0
+	for y, i := 0, 0; y < j.height; y++ {
+		for x := 0; x < j.width; x++ {
+			if restart > 0 && i > 0 && i%restart == 0 {
+				if err := b.reset(); err != nil {
+					return err
+				}
+				firstX, firstY = x, y
+			}
+			i++
+			for c := 0; c < n; c++ {
+				d, err := b.diff(tables[c])
+				if err != nil {
+					return fmt.Errorf("%s at sample %d,%d", err, x, y)
+				}
+				at := y*stride + x*n + c
+				var p int32
+				switch {
+				case x == firstX && y == firstY:
+					p = initial
+				case y == firstY:
+					p = int32(j.data[at-n])
+				case x == 0:
+					p = int32(j.data[at-stride])
+				default:
+					// left, above and above left
+					ra, rb, rc := int32(j.data[at-n]), int32(j.data[at-stride]), int32(j.data[at-stride-n])
+					switch predictor {
+					case 1:
+						p = ra
+					case 2:
+						p = rb
+					case 3:
+						p = rc
+					case 4:
+						p = ra + rb - rc
+					case 5:
+						p = ra + (rb-rc)>>1
+					case 6:
+						p = rb + (ra-rc)>>1
+					case 7:
+						p = (ra + rb) >> 1
+					}
+				}
+				j.data[at] = uint16((p + d) & mask)
+			}
+		}
+	}
+	if transform > 0 {
+		for i := range j.data {
+			j.data[i] <<= transform
+		}
+	}
+	return nil
+}
@@ -6,11 +6,12 @@ import (
 	// "github.com/garyhouston/tiff66"
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
-	"github.com/mdaffin/go-telegraf"
 	"golang.org/x/image/bmp"
 	"golang.org/x/image/tiff"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
@@ -19,72 +20,73 @@ import (
 
 //RaspberryPiCamera type to support the raspberry pi camera through the cli
 type RaspberryPiCamera struct {
-	Enable         bool
-	Interval       duration
-	FilenamePrefix string
-	OutputDir      string
-	ImageTypes     []string
-	args           *RaspiStillArgs
+	CameraConfig
+	ImageTypes []string
+	// Bracket takes a frame (or Burst frames) with each of these exposure settings
+	Bracket []RaspiBracket
+	args    *RaspiStillArgs
 }
 
-//RunWait start the camera on an interval capture
-func (cam *RaspberryPiCamera) RunWait(stop <-chan bool, captureTime chan<- telegraf.Measurement) {
-
-	waitForNextTimepoint := time.After(time.Until(time.Now().Add(cam.Interval.Duration).Truncate(cam.Interval.Duration)))
+//RaspiBracket is the exposure of one frame in a bracketed set, zero values leave raspistill's default
+type RaspiBracket struct {
+	EV           int
+	ShutterSpeed int
+}
 
-	select {
-	case <-stop:
-		return
-	case <-waitForNextTimepoint:
-		break
-	}
+// apply sets the exposure of the bracket on args
+func (b RaspiBracket) apply(args *RaspiStillArgs) {
+	args.EV = b.EV
+	args.ShutterSpeed = b.ShutterSpeed
+}
 
-	ticker := time.NewTicker(cam.Interval.Duration)
-	defer ticker.Stop()
+func init() {
+	registerCameraBackend("rpicamera", cameraBackend{
+		single: true,
+		label:  "Picam",
+		newCamera: func() Camera {
+			return &RaspberryPiCamera{
+				CameraConfig: CameraConfig{
+					Enable:   true,
+					Interval: duration{time.Duration(time.Minute * 5)},
+				},
+			}
+		},
+	})
+}
 
-	start := time.Now()
-	timestamp := time.Now().Truncate(cam.Interval.Duration).Format(config.TimestampFormat)
-	err := cam.capture(timestamp)
+//Describe returns a human readable summary of the camera, satisfies Camera
+func (cam *RaspberryPiCamera) Describe() string {
+	return cam.CameraConfig.describe()
+}
 
-	if err != nil {
-		errLog.Println("error capturing: ", err)
-	} else {
-		m := telegraf.MeasureFloat64("camera", "timing_capture_s", time.Since(start).Seconds())
-		m.AddTag("camera_name", cam.FilenamePrefix)
-		captureTime <- m
-		infoLog.Printf("%s capture took %s\n",cam.FilenamePrefix, time.Since(start))
-	}
-	for {
-		select {
-		case t := <-ticker.C:
-			if cam.Enable {
-				start := time.Now()
-				// Truncate the current time to the interval duration
-				timestamp := t.Truncate(cam.Interval.Duration).Format(config.TimestampFormat)
-				err := cam.capture(timestamp)
-				if err != nil {
-					errLog.Println("error capturing: ", err)
-				} else {
+//Health checks that raspistill is available, satisfies Camera
+func (cam *RaspberryPiCamera) Health(ctx context.Context) error {
+	_, err := os.Stat(raspistillPath)
+	return err
+}
 
-					m := telegraf.MeasureFloat64("camera", "timing_capture_s", time.Since(start).Seconds())
-					m.AddTag("camera_name", cam.FilenamePrefix)
-					captureTime <- m
-					infoLog.Printf("%s capture took %s\n", cam.FilenamePrefix, time.Since(start))
-				}
-			}
-		case <-stop:
-			return
+func (cam *RaspberryPiCamera) validate() (problems []string) {
+	for _, fileType := range cam.ImageTypes {
+		if !stringInSlice(fileType, []string{"jpeg", "jpg", "tif", "tiff", "bmp", "png", "gif"}) {
+			problems = append(problems, fmt.Sprintf("unsupported image type %s", fileType))
 		}
 	}
+	return
 }
 
 // is this function whats causing memory errors?
-func (cam *RaspberryPiCamera) getImage() ([]byte, error) {
+func (cam *RaspberryPiCamera) getImage(ctx context.Context) ([]byte, error) {
 	if cam.args == nil {
 		cam.args = NewRaspistillArgs()
 	}
-	cmd := createCommand(cam.args)
-	return cmd.Output()
+	cmd := createCommand(ctx, cam.args)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := startProcess(cmd); err != nil {
+		return nil, err
+	}
+	err := cam.waitProcess(ctx, cmd)
+	return stdout.Bytes(), err
 }
 
 // does this work the same way?
@@ -115,24 +117,52 @@ func (cam *RaspberryPiCamera) getImage() ([]byte, error) {
 //	return output, err
 //}
 
-func (cam *RaspberryPiCamera) capture(timestamp string) error {
+func (cam *RaspberryPiCamera) capture(ctx context.Context, timestamp string) error {
+	return cam.captureFrames(ctx, timestamp, nil)
+}
+
+// captureFrames captures the frames of a timepoint, satisfies groupMember
+func (cam *RaspberryPiCamera) captureFrames(ctx context.Context, timestamp string, sync *syncPoint) error {
 	if len(cam.ImageTypes) == 0 {
 		cam.ImageTypes = []string{"jpg", "tiff"}
 	}
+	bracket := cam.Bracket
+	if len(bracket) == 0 {
+		bracket = []RaspiBracket{{}}
+	}
+	frames := len(bracket) * cam.Burst
+	for i := 0; i < frames; i++ {
+		if i == 0 {
+			if err := sync.wait(ctx); err != nil {
+				return err
+			}
+			sync.shutter()
+		}
+		if err := cam.captureFrame(ctx, cam.frameName(timestamp, i, frames), bracket[i/cam.Burst]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureFrame takes a single frame in every one of the ImageTypes, named name with the file type as extension
+func (cam *RaspberryPiCamera) captureFrame(ctx context.Context, name string, bracket RaspiBracket) error {
 	for _, fileType := range cam.ImageTypes {
 		var image []byte
 		var err error
-		filePath := filepath.Join(cam.OutputDir, fmt.Sprintf("%s_%s.%s", cam.FilenamePrefix, timestamp, fileType))
+		filePath := filepath.Join(cam.OutputDir, fmt.Sprintf("%s.%s", name, fileType))
 		filePathLast := filepath.Join(cam.OutputDir, fmt.Sprintf("last_image.%s", fileType))
 		if stringInSlice(fileType, []string{"jpeg", "jpg"}) {
 			cam.args = &RaspiStillArgs{Encoding: "jpg", Quality: 100, Brightness: defBrightness}
-			image, err = cam.getImage()
+			bracket.apply(cam.args)
+			image, err = cam.getImage(ctx)
 			if err != nil {
 				return err
 			}
 		} else if stringInSlice(fileType, []string{"tif", "tiff"}) {
 			cam.args = &RaspiStillArgs{Encoding: "bmp", Brightness: defBrightness}
-			imageBMP, err := cam.getImage()
+			bracket.apply(cam.args)
+			imageBMP, err := cam.getImage(ctx)
 			if err != nil {
 				return err
 			}
@@ -154,15 +184,21 @@ func (cam *RaspberryPiCamera) capture(timestamp string) error {
 
 		} else if stringInSlice(fileType, []string{"bmp", "png", "gif"}) {
 			cam.args = &RaspiStillArgs{Encoding: fileType, Brightness: defBrightness}
-			image, err = cam.getImage()
+			bracket.apply(cam.args)
+			image, err = cam.getImage(ctx)
 			if err != nil {
 				return err
 			}
 		}
 
-		if err = ioutil.WriteFile(filePath, image, 0665); err != nil {
+		// write to a temporary file first so that a shutdown can't leave a half written image behind
+		if err = ioutil.WriteFile(filePath+".part", image, 0665); err != nil {
+			return err
+		}
+		if err = os.Rename(filePath+".part", filePath); err != nil {
 			return err
 		}
+		cam.addFiles(filePath)
 
 		if fileType == "jpg" {
 			// we actually dont want to fail here or anywhere
@@ -216,10 +252,11 @@ func stringInSlice(a string, list []string) bool {
 
 //this is all ripped straight from https://github.com/technomancers/piCamera, modified for raspistill
 const (
-	defBrightness = 50
-	defMode       = 0
-	defEncoding   = "jpg"
-	defQuality    = 75
+	raspistillPath = "/opt/vc/bin/raspistill"
+	defBrightness  = 50
+	defMode        = 0
+	defEncoding    = "jpg"
+	defQuality     = 75
 )
 
 //RaspiStillArgs are arguments used to set camera settings for the desired output
@@ -254,8 +291,8 @@ func NewRaspistillArgs() *RaspiStillArgs {
 	}
 }
 
-func createCommand(args *RaspiStillArgs) *exec.Cmd {
-	command := exec.Command("/opt/vc/bin/raspistill", "-t", "5")
+func createCommand(ctx context.Context, args *RaspiStillArgs) *exec.Cmd {
+	command := exec.CommandContext(ctx, raspistillPath, "-t", "5")
 	var final []string
 	if args.Width != 0 {
 		final = append(final, "-w", strconv.Itoa(args.Width))
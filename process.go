@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+//captureTimeoutError is returned when a capture process ran longer than the CaptureTimeout of its camera,
+//it is transient because a wedged camera often comes back once it is found again on the bus
+type captureTimeoutError struct {
+	command string
+	timeout time.Duration
+}
+
+func (e captureTimeoutError) Error() string {
+	return fmt.Sprintf("%s did not finish within %s and was killed", e.command, e.timeout)
+}
+
+// startProcess starts cmd in a process group of its own, so that it can be killed along with anything it started
+func startProcess(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd.Start()
+}
+
+// waitProcess waits for a command started with startProcess. If it runs longer than the CaptureTimeout
+// (or ctx is cancelled) its whole process group is killed.
+func (c *CameraConfig) waitProcess(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var expired <-chan time.Time
+	if c.CaptureTimeout.Duration > 0 {
+		timer := time.NewTimer(c.CaptureTimeout.Duration)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		return <-done
+	case <-expired:
+		killProcessGroup(cmd)
+		<-done
+		c.timeouts++
+		err := captureTimeoutError{command: filepath.Base(cmd.Path), timeout: c.CaptureTimeout.Duration}
+		errLog.Printf("%s: %s\n", c.FilenamePrefix, err)
+		return err
+	}
+}
+
+// killProcessGroup kills the process group led by cmd
+func killProcessGroup(cmd *exec.Cmd) {
+	// a negative pid signals the whole group
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// takeTimeouts returns the number of capture processes that timed out since it was last called
+func (c *CameraConfig) takeTimeouts() int {
+	timeouts := c.timeouts
+	c.timeouts = 0
+	return timeouts
+}
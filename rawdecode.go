@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tiff tags of the raw data in CR2 and DNG files
+const (
+	tiffTagNewSubfileType  = 254
+	tiffTagImageWidth      = 256
+	tiffTagImageLength     = 257
+	tiffTagBitsPerSample   = 258
+	tiffTagPhotometric     = 262
+	tiffTagRowsPerStrip    = 278
+	tiffTagTileWidth       = 322
+	tiffTagTileLength      = 323
+	tiffTagTileOffsets     = 324
+	tiffTagTileByteCounts  = 325
+	tiffTagCFARepeatDim    = 33421
+	tiffTagCFAPattern      = 33422
+	tiffTagMakerNote       = 37500
+	tiffTagDNGVersion      = 50706
+	tiffTagWhiteLevel      = 50717
+	tiffTagCR2Slices       = 50752
+	tiffTagActiveArea      = 50829
+	canonTagSensorInfo     = 0xe0
+	photometricCFA         = 32803
+	compressionNone        = 1
+	compressionLosslessJPG = 7
+)
+
+//rawImage is the sensor data of a RAW file, every pixel has one colour of the colour filter array
+type rawImage struct {
+	width, height int
+	// bits is the number of significant bits of the samples
+	bits int
+	// cfa is the colour of the pixels of every 2x2 block: 0 red, 1 green, 2 blue
+	cfa  [2][2]int
+	data []uint16
+}
+
+// isRawFile is true for the RAW files decodeRaw can decode
+func isRawFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".cr2" || ext == ".dng"
+}
+
+// decodeRaw decodes the sensor data of a Canon CR2 or a DNG file. It is the active area of the sensor without
+// the masked borders, without black level subtraction or white balance, so that the values stay linear.
+func decodeRaw(path string) (*rawImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t, first, err := newTiffReader(f, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	header := make([]byte, 16)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	tags, _, err := t.ifd(first)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	var raw *rawImage
+	switch {
+	case string(header[8:10]) == "CR":
+		// the header of a CR2 points at the IFD of the raw data
+		raw, err = t.decodeCR2(t.order.Uint32(header[12:]), tags)
+	case tags[tiffTagDNGVersion] != nil:
+		raw, err = t.decodeDNG(first)
+	default:
+		err = fmt.Errorf("neither a CR2 nor a DNG")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return raw, nil
+}
+
+// read returns count bytes from offset
+func (t *tiffReader) read(offset, count uint32) ([]byte, error) {
+	if int64(offset)+int64(count) > t.size {
+		return nil, fmt.Errorf("data at %d is beyond the end of the file", offset)
+	}
+	data := make([]byte, count)
+	_, err := t.r.ReadAt(data, int64(offset))
+	return data, err
+}
+
+// decodeCR2 decodes the lossless JPEG of a CR2 at offset and crops it to the borders in the maker note of ifd0.
+// Canon splits the sensor into vertical slices which are encoded one after the other, the CR2 slice tag has
+// their number and widths.
+func (t *tiffReader) decodeCR2(offset uint32, ifd0 map[uint16][]uint32) (*rawImage, error) {
+	borders, err := t.canonSensorBorders(ifd0)
+	if err != nil {
+		return nil, err
+	}
+	tags, _, err := t.ifd(offset)
+	if err != nil {
+		return nil, err
+	}
+	offsets, counts := tags[tiffTagStripOffsets], tags[tiffTagStripByteCounts]
+	if len(offsets) != 1 || len(counts) != 1 {
+		return nil, fmt.Errorf("no raw data")
+	}
+	data, err := t.read(offsets[0], counts[0])
+	if err != nil {
+		return nil, err
+	}
+	j, err := decodeLosslessJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file doesn't say, but Canon sensors start with red at the top left and the borders are even
+	raw := &rawImage{width: j.width * j.components, height: j.height, bits: j.precision, cfa: [2][2]int{{0, 1}, {1, 2}}}
+	left, top, right, bottom := borders[0], borders[1], borders[2], borders[3]
+	slices := tags[tiffTagCR2Slices]
+	if len(slices) != 3 || slices[1] == 0 {
+		raw.data = j.data
+		if err := raw.crop(left, top, right, bottom); err != nil {
+			return nil, err
+		}
+		return raw, nil
+	}
+	count, width, last := int(slices[0]), int(slices[1]), int(slices[2])
+	raw.width = count*width + last
+	if raw.width == 0 || len(j.data)/raw.width == 0 {
+		return nil, fmt.Errorf("invalid slices %v", slices)
+	}
+	raw.height = len(j.data) / raw.width
+	if err := raw.checkArea(left, top, right, bottom); err != nil {
+		return nil, err
+	}
+
+	// the slices are put together and cropped at once, the sensor data is tens of MB and isn't copied again
+	activeWidth, activeHeight := right-left, bottom-top
+	active := make([]uint16, activeWidth*activeHeight)
+	size := width * raw.height
+	for i, v := range j.data[:raw.width*raw.height] {
+		slice, sliceWidth := i/size, width
+		if slice >= count {
+			slice, sliceWidth = count, last
+		}
+		at := i - slice*size
+		x, y := slice*width+at%sliceWidth-left, at/sliceWidth-top
+		if x >= 0 && y >= 0 && x < activeWidth && y < activeHeight {
+			active[y*activeWidth+x] = v
+		}
+	}
+	raw.width, raw.height, raw.data = activeWidth, activeHeight, active
+	return raw, nil
+}
+
+// canonSensorBorders returns the left, top, right and bottom borders of the active area, exclusive of right and
+// bottom, from the sensor info in the Canon maker note of the Exif IFD of ifd0. Odd borders are rejected, the
+// colour filter array wouldn't start with red then.
+func (t *tiffReader) canonSensorBorders(ifd0 map[uint16][]uint32) (borders [4]int, err error) {
+	exif := ifd0[tiffTagExifIFD]
+	if len(exif) != 1 {
+		return borders, fmt.Errorf("no exif to find the sensor borders in")
+	}
+	entries, _, err := t.entries(exif[0])
+	if err != nil {
+		return borders, err
+	}
+	var info []uint32
+	for _, entry := range entries {
+		// the maker note is an IFD with offsets from the start of the file
+		if t.order.Uint16(entry) != tiffTagMakerNote {
+			continue
+		}
+		tags, _, err := t.ifd(t.order.Uint32(entry[8:]))
+		if err != nil {
+			return borders, fmt.Errorf("maker note: %s", err)
+		}
+		info = tags[canonTagSensorInfo]
+	}
+	// 1 and 2 are the sensor size, 5 to 8 the inclusive borders of the active area
+	if len(info) < 9 {
+		return borders, fmt.Errorf("no sensor info to find the sensor borders in")
+	}
+	left, top, right, bottom := int(info[5]), int(info[6]), int(info[7])+1, int(info[8])+1
+	if left%2 != 0 || top%2 != 0 {
+		return borders, fmt.Errorf("sensor borders at %d,%d aren't supported", left, top)
+	}
+	return [4]int{left, top, right, bottom}, nil
+}
+
+// checkArea checks that the area from left, top to right, bottom exclusive is on the sensor
+func (r *rawImage) checkArea(left, top, right, bottom int) error {
+	if left < 0 || top < 0 || right > r.width || bottom > r.height || left >= right || top >= bottom {
+		return fmt.Errorf("active area %d,%d-%d,%d is outside the %dx%d sensor", left, top, right, bottom, r.width, r.height)
+	}
+	return nil
+}
+
+// crop cuts r down to the area from left, top to right, bottom exclusive, the colour filter array starts there.
+// The rows only move towards the start of the data, so they are moved in place.
+func (r *rawImage) crop(left, top, right, bottom int) error {
+	if err := r.checkArea(left, top, right, bottom); err != nil {
+		return err
+	}
+	width, height := right-left, bottom-top
+	for y := 0; y < height; y++ {
+		copy(r.data[y*width:(y+1)*width], r.data[(top+y)*r.width+left:])
+	}
+	r.width, r.height, r.data = width, height, r.data[:width*height]
+	return nil
+}
+
+// decodeDNG decodes the CFA image of a DNG, found in the IFDs and SubIFDs from offset.
+// The tiles or strips are lossless JPEG or 16 bit uncompressed.
+func (t *tiffReader) decodeDNG(offset uint32) (*rawImage, error) {
+	var tags map[uint16][]uint32
+	queue := []uint32{offset}
+	for visited := 0; len(queue) > 0 && visited < 64 && tags == nil; visited++ {
+		ifd, next, err := t.ifd(queue[0])
+		if err != nil {
+			return nil, err
+		}
+		queue = queue[1:]
+		if subfile := ifd[tiffTagNewSubfileType]; (len(subfile) == 0 || subfile[0] == 0) &&
+			len(ifd[tiffTagPhotometric]) == 1 && ifd[tiffTagPhotometric][0] == photometricCFA {
+			tags = ifd
+		}
+		queue = append(queue, ifd[tiffTagSubIFDs]...)
+		if next != 0 {
+			queue = append(queue, next)
+		}
+	}
+	if tags == nil {
+		return nil, fmt.Errorf("no colour filter array image, linear DNGs aren't supported")
+	}
+
+	first := func(tag uint16, fallback uint32) uint32 {
+		if values := tags[tag]; len(values) > 0 {
+			return values[0]
+		}
+		return fallback
+	}
+	raw := &rawImage{
+		width:  int(first(tiffTagImageWidth, 0)),
+		height: int(first(tiffTagImageLength, 0)),
+		bits:   int(first(tiffTagBitsPerSample, 16)),
+	}
+	if white := first(tiffTagWhiteLevel, 0); white > 0 {
+		raw.bits = int(math.Ceil(math.Log2(float64(white) + 1)))
+	}
+	dim, pattern := tags[tiffTagCFARepeatDim], tags[tiffTagCFAPattern]
+	if len(dim) != 2 || dim[0] != 2 || dim[1] != 2 || len(pattern) != 4 {
+		return nil, fmt.Errorf("only 2x2 colour filter arrays are supported")
+	}
+	for i, colour := range pattern {
+		if colour > 2 {
+			return nil, fmt.Errorf("colour filter array colour %d isn't supported", colour)
+		}
+		raw.cfa[i/2][i%2] = int(colour)
+	}
+	if raw.width == 0 || raw.height == 0 {
+		return nil, fmt.Errorf("no image size")
+	}
+
+	// strips are tiles as wide as the image
+	tileWidth, tileHeight := int(first(tiffTagTileWidth, uint32(raw.width))), int(first(tiffTagTileLength, 0))
+	offsets, counts := tags[tiffTagTileOffsets], tags[tiffTagTileByteCounts]
+	if offsets == nil {
+		tileHeight = int(first(tiffTagRowsPerStrip, uint32(raw.height)))
+		offsets, counts = tags[tiffTagStripOffsets], tags[tiffTagStripByteCounts]
+	}
+	if tileWidth == 0 || tileHeight == 0 || len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, fmt.Errorf("no raw data")
+	}
+	compression := first(tiffTagCompression, compressionNone)
+
+	// as with the lossless JPEG, every sample takes a bit at least
+	var size int64
+	for _, count := range counts {
+		size += int64(count)
+	}
+	if int64(raw.width)*int64(raw.height) > size*8 {
+		return nil, fmt.Errorf("%dx%d is larger than its %d bytes of raw data", raw.width, raw.height, size)
+	}
+	raw.data = make([]uint16, raw.width*raw.height)
+	across := (raw.width + tileWidth - 1) / tileWidth
+	for i := range offsets {
+		data, err := t.read(offsets[i], counts[i])
+		if err != nil {
+			return nil, err
+		}
+		var samples []uint16
+		width := tileWidth
+		switch compression {
+		case compressionLosslessJPG:
+			j, err := decodeLosslessJPEG(data)
+			if err != nil {
+				return nil, fmt.Errorf("tile %d: %s", i, err)
+			}
+			samples, width = j.data, j.width*j.components
+		case compressionNone:
+			if raw.bits > 16 || first(tiffTagBitsPerSample, 16) != 16 {
+				return nil, fmt.Errorf("uncompressed raw data of %d bits isn't supported", first(tiffTagBitsPerSample, 16))
+			}
+			samples = make([]uint16, len(data)/2)
+			for k := range samples {
+				samples[k] = t.order.Uint16(data[k*2:])
+			}
+		default:
+			return nil, fmt.Errorf("raw data compression %d isn't supported", compression)
+		}
+		x0, y0 := i%across*tileWidth, i/across*tileHeight
+		for k, v := range samples {
+			x, y := x0+k%width, y0+k/width
+			if k%width < tileWidth && x < raw.width && y < raw.height {
+				raw.data[y*raw.width+x] = v
+			}
+		}
+	}
+	// the colour filter array pattern starts at the active area
+	if area := tags[tiffTagActiveArea]; len(area) == 4 {
+		if err := raw.crop(int(area[1]), int(area[0]), int(area[3]), int(area[2])); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// demosaicRow interpolates the missing colours of row y bilinearly from the neighbouring pixels with that colour.
+// The RGB values are scaled to 16 bits.
+func (r *rawImage) demosaicRow(y int, row []uint16) {
+	shift := uint(0)
+	if r.bits > 0 && r.bits < 16 {
+		shift = uint(16 - r.bits)
+	}
+	for x := 0; x < r.width; x++ {
+		var sum, n [3]int
+		for yy := y - 1; yy <= y+1; yy++ {
+			if yy < 0 || yy >= r.height {
+				continue
+			}
+			for xx := x - 1; xx <= x+1; xx++ {
+				if xx < 0 || xx >= r.width {
+					continue
+				}
+				colour := r.cfa[yy&1][xx&1]
+				sum[colour] += int(r.data[yy*r.width+xx])
+				n[colour]++
+			}
+		}
+		own := r.cfa[y&1][x&1]
+		for colour := 0; colour < 3; colour++ {
+			v := 0
+			switch {
+			case colour == own:
+				v = int(r.data[y*r.width+x])
+			case n[colour] > 0:
+				v = sum[colour] / n[colour]
+			}
+			row[x*3+colour] = uint16(v << shift)
+		}
+	}
+}
+
+// writeTIFF writes the demosaiced image as an uncompressed 16 bit RGB TIFF, a row at a time
+func (r *rawImage) writeTIFF(w io.Writer) error {
+	size := uint64(r.width) * uint64(r.height) * 6
+	if size > math.MaxUint32 {
+		return fmt.Errorf("%dx%d is too large for a tiff", r.width, r.height)
+	}
+	const entries = 10
+	bitsAt := uint32(8 + 2 + entries*12 + 4)
+	dataAt := bitsAt + 6
+
+	b := bufio.NewWriter(w)
+	write := func(v interface{}) {
+		binary.Write(b, binary.LittleEndian, v)
+	}
+	b.WriteString("II")
+	write(uint16(42))
+	write(uint32(8))
+	write(uint16(entries))
+	for _, e := range []struct {
+		tag, typ     uint16
+		count, value uint32
+	}{
+		{tiffTagImageWidth, 4, 1, uint32(r.width)},
+		{tiffTagImageLength, 4, 1, uint32(r.height)},
+		{tiffTagBitsPerSample, 3, 3, bitsAt},
+		{tiffTagCompression, 3, 1, compressionNone},
+		{tiffTagPhotometric, 3, 1, 2}, // RGB
+		{tiffTagStripOffsets, 4, 1, dataAt},
+		{277, 3, 1, 3}, // SamplesPerPixel
+		{tiffTagRowsPerStrip, 4, 1, uint32(r.height)},
+		{tiffTagStripByteCounts, 4, 1, uint32(size)},
+		{284, 3, 1, 1}, // PlanarConfiguration, contiguous
+	} {
+		// a SHORT value is in the first two bytes of the value, which a little endian uint32 writes first
+		write(e.tag)
+		write(e.typ)
+		write(e.count)
+		write(e.value)
+	}
+	write(uint32(0))
+	write([3]uint16{16, 16, 16})
+
+	// binary.Write would allocate the bytes of every row
+	row, out := make([]uint16, r.width*3), make([]byte, r.width*6)
+	for y := 0; y < r.height; y++ {
+		r.demosaicRow(y, row)
+		for i, v := range row {
+			binary.LittleEndian.PutUint16(out[i*2:], v)
+		}
+		b.Write(out)
+	}
+	return b.Flush()
+}
+
+// convertRaw decodes a CR2 or DNG file and writes it as a linear 16 bit TIFF to tiffPath
+func convertRaw(rawPath, tiffPath string) error {
+	raw, err := decodeRaw(rawPath)
+	if err != nil {
+		return err
+	}
+	// written next to it first so that a shutdown can't leave a half written image behind
+	f, err := os.Create(tiffPath + ".part")
+	if err != nil {
+		return err
+	}
+	if err := raw.writeTIFF(f); err != nil {
+		f.Close()
+		os.Remove(tiffPath + ".part")
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tiffPath+".part", tiffPath)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"sort"
+)
+
+// tiff tags that locate the images in a TIFF based RAW file
+const (
+	tiffTagCompression         = 259
+	tiffTagStripOffsets        = 273
+	tiffTagStripByteCounts     = 279
+	tiffTagSubIFDs             = 330
+	tiffTagJPEGInterchange     = 513
+	tiffTagJPEGInterchangeSize = 514
+	tiffTagExifIFD             = 34665
+)
+
+//tiffReader reads the IFDs of a TIFF based RAW file like CR2, NEF, ARW or DNG without loading the whole file
+type tiffReader struct {
+	r     io.ReaderAt
+	size  int64
+	order binary.ByteOrder
+}
+
+// newTiffReader checks the header of a TIFF based file and returns a reader with the offset of its first IFD
+func newTiffReader(r io.ReaderAt, size int64) (*tiffReader, uint32, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, 0, fmt.Errorf("not a tiff based raw file: %s", err)
+	}
+	t := &tiffReader{r: r, size: size}
+	switch string(header[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("not a tiff based raw file")
+	}
+	// 42 for TIFF, CR2, NEF, ARW and DNG, Olympus and Panasonic have their own
+	switch t.order.Uint16(header[2:]) {
+	case 42, 0x4f52, 0x5352, 0x55:
+	default:
+		return nil, 0, fmt.Errorf("not a tiff based raw file")
+	}
+	return t, t.order.Uint32(header[4:]), nil
+}
+
+// values reads the BYTE, SHORT, LONG or IFD values of an IFD entry
+func (t *tiffReader) values(entry []byte) ([]uint32, error) {
+	typ, count := t.order.Uint16(entry[2:]), t.order.Uint32(entry[4:])
+	var size uint32
+	switch typ {
+	case 1:
+		size = 1
+	case 3:
+		size = 2
+	case 4, 13:
+		size = 4
+	default:
+		return nil, nil
+	}
+	if count > 1<<16 {
+		return nil, fmt.Errorf("tiff entry with %d values", count)
+	}
+	data := entry[8:12]
+	if count*size > 4 {
+		data = make([]byte, count*size)
+		if _, err := t.r.ReadAt(data, int64(t.order.Uint32(entry[8:]))); err != nil {
+			return nil, err
+		}
+	}
+	values := make([]uint32, count)
+	for i := range values {
+		switch size {
+		case 1:
+			values[i] = uint32(data[i])
+		case 2:
+			values[i] = uint32(t.order.Uint16(data[i*2:]))
+		default:
+			values[i] = t.order.Uint32(data[i*4:])
+		}
+	}
+	return values, nil
+}
+
+// entries reads the 12 byte entries of the IFD at offset, and the offset of the next IFD
+func (t *tiffReader) entries(offset uint32) (entries [][]byte, next uint32, err error) {
+	countData := make([]byte, 2)
+	if _, err := t.r.ReadAt(countData, int64(offset)); err != nil {
+		return nil, 0, err
+	}
+	count := int(t.order.Uint16(countData))
+	data := make([]byte, count*12+4)
+	if _, err := t.r.ReadAt(data, int64(offset)+2); err != nil {
+		return nil, 0, err
+	}
+	for i := 0; i < count; i++ {
+		entries = append(entries, data[i*12:i*12+12])
+	}
+	return entries, t.order.Uint32(data[count*12:]), nil
+}
+
+// ifd reads the entries of the IFD at offset with their values by tag, and the offset of the next IFD
+func (t *tiffReader) ifd(offset uint32) (tags map[uint16][]uint32, next uint32, err error) {
+	entries, next, err := t.entries(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	tags = make(map[uint16][]uint32)
+	for _, entry := range entries {
+		values, err := t.values(entry)
+		if err != nil {
+			return nil, 0, err
+		}
+		tags[t.order.Uint16(entry)] = values
+	}
+	return tags, next, nil
+}
+
+//tiffSpan is a run of bytes in the file that may hold a JPEG
+type tiffSpan struct {
+	offset, length int64
+}
+
+// jpegSpans walks every IFD, SubIFD and the Exif IFD from offset and returns the spans that may hold JPEGs:
+// thumbnails and previews given as JPEGInterchangeFormat and JPEG compressed strips
+func (t *tiffReader) jpegSpans(offset uint32) ([]tiffSpan, error) {
+	var spans []tiffSpan
+	visited := make(map[uint32]bool)
+	queue := []uint32{offset}
+	for len(queue) > 0 && len(visited) < 64 {
+		offset, queue = queue[0], queue[1:]
+		if offset == 0 || visited[offset] || int64(offset) >= t.size {
+			continue
+		}
+		visited[offset] = true
+
+		tags, next, err := t.ifd(offset)
+		if err != nil {
+			return spans, err
+		}
+		queue = append(queue, tags[tiffTagSubIFDs]...)
+		queue = append(queue, tags[tiffTagExifIFD]...)
+		queue = append(queue, next)
+
+		if start, size := tags[tiffTagJPEGInterchange], tags[tiffTagJPEGInterchangeSize]; len(start) == 1 && len(size) == 1 {
+			spans = append(spans, tiffSpan{int64(start[0]), int64(size[0])})
+		}
+		// strips are only a JPEG together if they follow each other
+		offsets, sizes := tags[tiffTagStripOffsets], tags[tiffTagStripByteCounts]
+		if compression := tags[tiffTagCompression]; len(compression) == 1 && (compression[0] == 6 || compression[0] == 7) &&
+			len(offsets) > 0 && len(offsets) == len(sizes) {
+			span := tiffSpan{int64(offsets[0]), 0}
+			for i := range offsets {
+				if int64(offsets[i]) != span.offset+span.length {
+					break
+				}
+				span.length += int64(sizes[i])
+			}
+			spans = append(spans, span)
+		}
+	}
+	return spans, nil
+}
+
+// rawPreviewImage decodes the largest JPEG embedded in a TIFF based RAW file, cameras keep a full size or
+// screen size preview next to the raw data. JPEGs image/jpeg can't decode are passed over, like the lossless
+// raw data of a CR2 or strips that need the tables of their TIFF.
+func rawPreviewImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t, first, err := newTiffReader(f, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	spans, err := t.jpegSpans(first)
+	if err != nil && len(spans) == 0 {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	// only the headers are read to pick the largest, the raw data of a CR2 alone is several MB
+	type preview struct {
+		section *io.SectionReader
+		area    int
+	}
+	var previews []preview
+	for _, span := range spans {
+		if span.length < 4 || span.offset+span.length > info.Size() {
+			continue
+		}
+		section := io.NewSectionReader(f, span.offset, span.length)
+		if config, err := jpeg.DecodeConfig(section); err == nil {
+			previews = append(previews, preview{section, config.Width * config.Height})
+		}
+	}
+	sort.Slice(previews, func(i, j int) bool {
+		return previews[i].area > previews[j].area
+	})
+	for _, p := range previews {
+		p.section.Seek(0, io.SeekStart)
+		if img, err := jpeg.Decode(p.section); err == nil {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no jpeg preview", path)
+}
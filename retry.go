@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+)
+
+//permanentError marks capture errors that retrying won't fix, eg a camera that isn't connected
+type permanentError struct {
+	error
+}
+
+//transientError marks capture errors worth another attempt although their kind isn't, eg a camera that was lost
+//and found again
+type transientError struct {
+	error
+}
+
+// isTransient returns whether err might go away by itself, like an I/O error or a busy port
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case permanentError:
+		return false
+	case transientError:
+		return true
+	case gphotoError:
+		return e.transient()
+	case *exec.Error:
+		// the command could not be found or run at all
+		return false
+	case *os.PathError:
+		return !os.IsNotExist(e) && !os.IsPermission(e)
+	}
+	return true
+}
+
+// captureWithRetries captures timestamp, retrying transient errors up to Retries times.
+// The wait between attempts starts at RetryBackoff and doubles every retry.
+// Captures run with captureCtx, if ctx is cancelled while waiting between attempts it gives up and returns stopped.
+func captureWithRetries(ctx, captureCtx context.Context, cam Camera, timestamp string) (retries int, stopped bool, err error) {
+	c := cam.Config()
+	backoff := c.RetryBackoff.Duration
+	for {
+		err = cam.capture(captureCtx, timestamp)
+		if err == nil || !isTransient(err) || retries >= c.Retries {
+			return
+		}
+		warnLog.Printf("%s capture of %s failed, retrying in %s: %s\n", c.FilenamePrefix, timestamp, backoff, err)
+
+		wait := time.NewTimer(backoff)
+		select {
+		case <-wait.C:
+		case <-ctx.Done():
+			wait.Stop()
+			return retries, true, err
+		}
+		retries++
+		backoff *= 2
+	}
+}
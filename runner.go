@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"github.com/mdaffin/go-telegraf"
+	"os"
+	"time"
+)
+
+//cameraRunner runs RunWait for the configured cameras, on reload only the cameras whose settings changed are restarted
+type cameraRunner struct {
+	// captureCtx is passed on to every capture, cancelling it kills them
+	captureCtx context.Context
+	timingChan chan telegraf.Measurement
+	write      func(telegraf.Measurement)
+	running    map[string]*runningCamera
+}
+
+//runningCamera is a camera whose RunWait has been started
+type runningCamera struct {
+	cam  Camera
+	stop context.CancelFunc
+	// done receives the first timepoint the camera didn't get to once RunWait returns
+	done chan time.Time
+}
+
+func newCameraRunner(captureCtx context.Context, write func(telegraf.Measurement)) *cameraRunner {
+	return &cameraRunner{
+		captureCtx: captureCtx,
+		// buffered so that cameras don't stall while the runner is busy reloading
+		timingChan: make(chan telegraf.Measurement, 100),
+		write:      write,
+		running:    make(map[string]*runningCamera),
+	}
+}
+
+// start starts an enabled and healthy camera capturing at its timepoints from the time from. It is described
+// before its RunWait starts, a running camera is only touched from its own goroutine.
+func (r *cameraRunner) start(name string, cam Camera, from time.Time) {
+	if !cam.Config().Enable || cam.Config().group != "" {
+		return
+	}
+	if err := cam.Health(context.Background()); err != nil {
+		errLog.Printf("%s not started: %s\n", name, err)
+		return
+	}
+	os.MkdirAll(cam.Config().OutputDir, 0777)
+	printCameras(cam)
+
+	ctx, stop := context.WithCancel(context.Background())
+	rc := &runningCamera{cam: cam, stop: stop, done: make(chan time.Time, 1)}
+	r.running[name] = rc
+	go func() {
+		rc.done <- RunWait(ctx, r.captureCtx, cam, r.timingChan, from)
+	}()
+}
+
+// stop stops a running camera and waits for a capture in progress to finish, handling measurements in the meantime.
+// It returns the first timepoint the camera didn't get to.
+func (r *cameraRunner) stop(name string) time.Time {
+	rc := r.running[name]
+	delete(r.running, name)
+	rc.stop()
+	for {
+		select {
+		case measurement := <-r.timingChan:
+			r.write(measurement)
+		case next := <-rc.done:
+			return next
+		}
+	}
+}
+
+// apply starts the cameras of c and stops the running ones that were removed or changed.
+// Unchanged cameras keep running on their schedule and take the place of their copy in c, changed ones
+// carry on from the first timepoint they didn't get to, so that no timepoint is missed or captured twice.
+func (r *cameraRunner) apply(c *GlobalConfig) {
+	resume := make(map[string]time.Time)
+	for name, rc := range r.running {
+		if cam, exists := c.Cameras[name]; exists && sameSettings(rc.cam, cam) {
+			c.Cameras[name] = rc.cam
+			continue
+		}
+		infoLog.Printf("stopping %s, its settings changed\n", name)
+		resume[name] = r.stop(name)
+	}
+
+	for name, cam := range c.Cameras {
+		if _, running := r.running[name]; running {
+			continue
+		}
+		from := resume[name]
+		if from.IsZero() {
+			from = time.Now()
+		}
+		r.start(name, cam, from)
+	}
+}
+
+// stopAll stops every camera and waits up to timeout for captures in progress to finish.
+// It returns false if some are still running, they can be killed by cancelling the captureCtx.
+func (r *cameraRunner) stopAll(timeout time.Duration) bool {
+	for _, rc := range r.running {
+		rc.stop()
+	}
+	expired := time.After(timeout)
+	for name, rc := range r.running {
+	wait:
+		for {
+			select {
+			case measurement := <-r.timingChan:
+				r.write(measurement)
+			case <-rc.done:
+				break wait
+			case <-expired:
+				return false
+			}
+		}
+		delete(r.running, name)
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mdaffin/go-telegraf"
+	"github.com/robfig/cron"
+	"strings"
+	"time"
+)
+
+//overrunPolicy decides what happens to the timepoints that passed while a capture was still running
+type overrunPolicy string
+
+const (
+	// overrunSkip drops every missed timepoint and waits for the next one
+	overrunSkip overrunPolicy = "skip"
+	// overrunQueue captures the first missed timepoint as soon as the capture finishes and drops the rest
+	overrunQueue overrunPolicy = "queue"
+	// overrunImmediate captures the latest missed timepoint as soon as the capture finishes and drops the rest
+	overrunImmediate overrunPolicy = "immediate"
+)
+
+func (p *overrunPolicy) UnmarshalText(text []byte) error {
+	switch policy := overrunPolicy(strings.ToLower(string(text))); policy {
+	case overrunSkip, overrunQueue, overrunImmediate:
+		*p = policy
+		return nil
+	}
+	return fmt.Errorf("invalid overrun policy %q, expected skip, queue or immediate", text)
+}
+
+//captureResult records when a timepoint was scheduled, started and finished
+type captureResult struct {
+	Timepoint, Start, Finish time.Time
+	// Retries is the number of times the capture was retried after transient errors
+	Retries int
+	// Files are the files the capture wrote, eg a jpg and a cr2 for every frame
+	Files []string
+	Err   error
+}
+
+// lateness is how long after its timepoint the capture started
+func (r captureResult) lateness() time.Duration {
+	return r.Start.Sub(r.Timepoint)
+}
+
+//captureReporter is implemented by cameras with measurements of their own about the last capture
+type captureReporter interface {
+	report(m *telegraf.Measurement)
+}
+
+//cameraMaintainer is implemented by camera types with work of their own between captures, like downloading the
+//frames on their card. It is done by the goroutine that captures, so that it never runs during a capture.
+type cameraMaintainer interface {
+	// nextMaintenance returns when maintain is due, zero for never
+	nextMaintenance(now time.Time) time.Time
+	maintain(ctx context.Context, measurements chan<- telegraf.Measurement)
+}
+
+//cronSchedule is a cron expression with a leading seconds field, eg "0 */15 6-19 * * MON-FRI"
+type cronSchedule struct {
+	cron.Schedule
+	spec string
+}
+
+func (s *cronSchedule) UnmarshalText(text []byte) error {
+	var err error
+	s.spec = string(text)
+	s.Schedule, err = cron.Parse(s.spec)
+	return err
+}
+
+func (s cronSchedule) String() string {
+	return s.spec
+}
+
+// nextTimepoint returns the first scheduled timepoint after t.
+// Cameras with a Schedule use the earliest of its cron expressions, otherwise timepoints are
+// aligned to the Interval so that filename timestamps line up between cameras.
+func (c *CameraConfig) nextTimepoint(t time.Time) time.Time {
+	return nextScheduled(t, c.Interval.Duration, c.Schedule)
+}
+
+// nextScheduled returns the first time after t matched by any of schedule, or aligned to interval without one
+func nextScheduled(t time.Time, interval time.Duration, schedule []cronSchedule) time.Time {
+	if len(schedule) == 0 {
+		return t.Add(interval).Truncate(interval)
+	}
+	var next time.Time
+	for _, s := range schedule {
+		n := s.Next(t)
+		// a zero time means the expression never matches
+		if n.IsZero() {
+			continue
+		}
+		if next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	return next
+}
+
+// describeSchedule returns the Schedule if it is set, otherwise the Interval
+func (c *CameraConfig) describeSchedule() string {
+	if len(c.Schedule) == 0 {
+		return c.Interval.String()
+	}
+	specs := make([]string, len(c.Schedule))
+	for i, s := range c.Schedule {
+		specs[i] = s.String()
+	}
+	return strings.Join(specs, " | ")
+}
+
+//RunWait start the camera capturing at every scheduled timepoint from the time from onwards, until ctx is cancelled.
+// Captures run with captureCtx so that one in progress can finish after ctx is cancelled, cancel captureCtx to kill it.
+// It returns the first timepoint it didn't get to, so that a camera restarted from there neither misses nor repeats one.
+func RunWait(ctx, captureCtx context.Context, cam Camera, captureTime chan<- telegraf.Measurement, from time.Time) time.Time {
+	c := cam.Config()
+	timepoint := c.nextTimepoint(from.Add(-time.Nanosecond))
+	for {
+		if timepoint.IsZero() {
+			errLog.Printf("%s has no timepoints scheduled\n", c.FilenamePrefix)
+			<-ctx.Done()
+			return timepoint
+		}
+		if ctx.Err() != nil {
+			return timepoint
+		}
+		waitForNextTimepoint := time.NewTimer(time.Until(timepoint))
+		stopMaintenance := func() bool { return false }
+		// a nil channel never fires for cameras without maintenance
+		var maintenance <-chan time.Time
+		m, maintained := cam.(cameraMaintainer)
+		if maintained && c.Enable {
+			if next := m.nextMaintenance(time.Now()); !next.IsZero() {
+				timer := time.NewTimer(time.Until(next))
+				maintenance = timer.C
+				stopMaintenance = timer.Stop
+			}
+		}
+
+		select {
+		case <-maintenance:
+			waitForNextTimepoint.Stop()
+			m.maintain(captureCtx, captureTime)
+		case <-waitForNextTimepoint.C:
+			stopMaintenance()
+			// a missed timepoint to capture straight away, see overrunPolicy
+			var pending time.Time
+			if c.Enable && c.inCalendar(timepoint) && c.inCaptureWindow(timepoint, captureTime) {
+				result, stopped := runCapture(ctx, captureCtx, cam, timepoint)
+				if stopped {
+					return c.nextTimepoint(timepoint)
+				}
+				if err := c.recordStatus(result); err != nil {
+					warnLog.Printf("cannot record the status of %s: %s\n", c.FilenamePrefix, err)
+				}
+				var skipped int
+				pending, skipped = c.overrun(result)
+
+				m := telegraf.MeasureFloat64("camera", "lateness_s", result.lateness().Seconds())
+				if result.Err == nil {
+					m.AddFloat64("timing_capture_s", result.Finish.Sub(result.Start).Seconds())
+				} else {
+					m.AddTag("error", errorKind(result.Err))
+				}
+				m.AddInt("skipped_timepoints", skipped)
+				m.AddInt("retries", result.Retries)
+				m.AddInt("capture_timeouts", c.takeTimeouts())
+				m.AddFloat64("lock_wait_s", c.takeLockWait().Seconds())
+				m.AddTag("camera_name", c.FilenamePrefix)
+				if r, ok := cam.(captureReporter); ok {
+					r.report(&m)
+				}
+				captureTime <- m
+			}
+			timepoint = pending
+			if pending.IsZero() {
+				timepoint = c.nextTimepoint(time.Now())
+			}
+		case <-ctx.Done():
+			waitForNextTimepoint.Stop()
+			stopMaintenance()
+			return timepoint
+		}
+	}
+}
+
+// runCapture captures the scheduled timepoint and records when it started and finished
+func runCapture(ctx, captureCtx context.Context, cam Camera, timepoint time.Time) (result captureResult, stopped bool) {
+	c := cam.Config()
+	result = captureResult{Timepoint: timepoint, Start: time.Now()}
+	timestamp := timepoint.Format(c.timestampFormat)
+	result.Retries, stopped, result.Err = captureWithRetries(ctx, captureCtx, cam, timestamp)
+	result.Finish = time.Now()
+	result.Files = c.takeFiles()
+	if result.Err != nil {
+		errLog.Printf("%s capture of %s failed (%s): %s\n", c.FilenamePrefix, timestamp, errorKind(result.Err), result.Err)
+		return
+	}
+	infoLog.Printf("%s capture of %s started %s late and took %s\n",
+		c.FilenamePrefix, timestamp, result.lateness(), result.Finish.Sub(result.Start))
+	return
+}
+
+// overrun applies the OverrunPolicy to the timepoints that passed while result was captured.
+// It returns the timepoint to capture next, if any, and the number of timepoints skipped.
+func (c *CameraConfig) overrun(result captureResult) (pending time.Time, skipped int) {
+	var missed []time.Time
+	for t := c.nextTimepoint(result.Timepoint); !t.IsZero() && !t.After(result.Finish); t = c.nextTimepoint(t) {
+		missed = append(missed, t)
+	}
+	if len(missed) == 0 {
+		return time.Time{}, 0
+	}
+
+	switch c.OverrunPolicy {
+	case overrunQueue:
+		pending = missed[0]
+	case overrunImmediate:
+		pending = missed[len(missed)-1]
+	}
+	skipped = len(missed)
+	if !pending.IsZero() {
+		skipped--
+	}
+	warnLog.Printf("%s capture of %s overran by %s, skipped %d timepoints\n",
+		c.FilenamePrefix, result.Timepoint.Format(c.timestampFormat), result.Finish.Sub(missed[0]), skipped)
+	return pending, skipped
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mdaffin/go-telegraf"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+	// the sun is up when its upper edge is over the horizon, including refraction
+	sunriseAltitude = -0.833
+	earthObliquity  = 23.44
+)
+
+//solarTime is a time of day relative to a solar event, eg "sunrise-30m" or "sunset+1h"
+type solarTime struct {
+	event  string
+	offset time.Duration
+}
+
+func (s *solarTime) UnmarshalText(text []byte) error {
+	spec := strings.ToLower(strings.TrimSpace(string(text)))
+	for _, event := range []string{"sunrise", "sunset"} {
+		if !strings.HasPrefix(spec, event) {
+			continue
+		}
+		s.event = event
+		s.offset = 0
+		if offset := strings.TrimPrefix(spec, event); offset != "" {
+			if offset[0] != '+' && offset[0] != '-' {
+				return fmt.Errorf("invalid offset in %q, expected eg %s+30m", text, event)
+			}
+			var err error
+			if s.offset, err = time.ParseDuration(offset); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid solar time %q, expected sunrise or sunset with an optional offset", text)
+}
+
+func (s solarTime) String() string {
+	if s.offset == 0 {
+		return s.event
+	}
+	if s.offset > 0 {
+		return s.event + "+" + s.offset.String()
+	}
+	return s.event + s.offset.String()
+}
+
+// isZero is true if the solar time was not set in the config
+func (s solarTime) isZero() bool {
+	return s.event == ""
+}
+
+// at returns the solar time on the day of the given sunrise and sunset
+func (s solarTime) at(sunrise, sunset time.Time) time.Time {
+	if s.event == "sunrise" {
+		return sunrise.Add(s.offset)
+	}
+	return sunset.Add(s.offset)
+}
+
+// sunriseSunset computes sunrise and sunset on the day of date for a position in degrees (north and east positive),
+// using the sunrise equation so that it works offline.
+// During midnight sun the whole day is returned, during polar night sunrise and sunset are both at solar noon.
+func sunriseSunset(date time.Time, latitude, longitude float64) (sunrise, sunset time.Time) {
+	year, month, day := date.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	n := math.Ceil(float64(midnight.Unix())/86400 + julianUnixEpoch - julian2000 + 0.0008)
+
+	// mean solar noon, solar mean anomaly, equation of the center and ecliptic longitude
+	meanNoon := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sinDeg(anomaly) + 0.0200*sinDeg(2*anomaly) + 0.0003*sinDeg(3*anomaly)
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := julian2000 + meanNoon + 0.0053*sinDeg(anomaly) - 0.0069*sinDeg(2*eclipticLongitude)
+
+	declination := math.Asin(sinDeg(eclipticLongitude) * sinDeg(earthObliquity))
+	cosHourAngle := (sinDeg(sunriseAltitude) - sinDeg(latitude)*math.Sin(declination)) / (cosDeg(latitude) * math.Cos(declination))
+
+	solarNoon := julianToTime(transit, date.Location())
+	switch {
+	case cosHourAngle < -1:
+		start := time.Date(year, month, day, 0, 0, 0, 0, date.Location())
+		return start, start.AddDate(0, 0, 1)
+	case cosHourAngle > 1:
+		return solarNoon, solarNoon
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+	return julianToTime(transit-hourAngle/360, date.Location()), julianToTime(transit+hourAngle/360, date.Location())
+}
+
+func julianToTime(julian float64, loc *time.Location) time.Time {
+	seconds := (julian - julianUnixEpoch) * 86400
+	return time.Unix(0, int64(seconds*float64(time.Second))).Round(time.Second).In(loc)
+}
+
+func sinDeg(degrees float64) float64 {
+	return math.Sin(degrees * math.Pi / 180)
+}
+
+func cosDeg(degrees float64) float64 {
+	return math.Cos(degrees * math.Pi / 180)
+}
+
+// captureWindow returns the times between which the camera captures on the day of t.
+// If only one of CaptureFrom and CaptureUntil is set the window is open until the end or from the start of the day.
+func (c *CameraConfig) captureWindow(t time.Time) (from, until time.Time) {
+	year, month, day := t.Date()
+	from = time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	until = from.AddDate(0, 0, 1)
+	sunrise, sunset := sunriseSunset(t, c.Latitude, c.Longitude)
+	if !c.CaptureFrom.isZero() {
+		from = c.CaptureFrom.at(sunrise, sunset)
+	}
+	if !c.CaptureUntil.isZero() {
+		until = c.CaptureUntil.at(sunrise, sunset)
+	}
+	return
+}
+
+// inCaptureWindow returns whether the timepoint is inside the cameras daily capture window.
+// The window is logged and reported the first time it is computed for a day.
+func (c *CameraConfig) inCaptureWindow(timepoint time.Time, report chan<- telegraf.Measurement) bool {
+	if c.CaptureFrom.isZero() && c.CaptureUntil.isZero() {
+		return true
+	}
+	if day := timepoint.Format("2006-01-02"); day != c.windowDay {
+		c.windowDay = day
+		c.windowFrom, c.windowUntil = c.captureWindow(timepoint)
+		infoLog.Printf("%s capture window for %s is %s to %s\n",
+			c.FilenamePrefix, day, c.windowFrom.Format("15:04:05"), c.windowUntil.Format("15:04:05"))
+		m := telegraf.MeasureInt64("camera", "capture_window_from", c.windowFrom.Unix())
+		m.AddInt64("capture_window_until", c.windowUntil.Unix())
+		m.AddTag("camera_name", c.FilenamePrefix)
+		report <- m
+	}
+	// a window that ends before it starts spans the night, eg from sunset to sunrise
+	if c.windowUntil.Before(c.windowFrom) {
+		return !timepoint.Before(c.windowFrom) || timepoint.Before(c.windowUntil)
+	}
+	return !timepoint.Before(c.windowFrom) && timepoint.Before(c.windowUntil)
+}
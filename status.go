@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const statusFilename = "last_capture.json"
+
+//captureStatus is the result of the last capture of a camera, kept next to its last_image.jpg for `go-eyepi status`
+type captureStatus struct {
+	Timepoint, Start, Finish time.Time
+	Retries                  int
+	Files                    []string `json:",omitempty"`
+	Error                    string   `json:",omitempty"`
+}
+
+// recordStatus writes the result of a capture to the output directory of the camera
+func (c *CameraConfig) recordStatus(result captureResult) error {
+	status := captureStatus{
+		Timepoint: result.Timepoint,
+		Start:     result.Start,
+		Finish:    result.Finish,
+		Retries:   result.Retries,
+		Files:     result.Files,
+	}
+	if result.Err != nil {
+		status.Error = result.Err.Error()
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return err
+	}
+	// written next to the status and renamed over it, so that it is never read half written
+	path := filepath.Join(c.OutputDir, statusFilename)
+	if err := ioutil.WriteFile(path+".part", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".part", path)
+}
+
+// readStatus returns the result of the last capture of the camera, by this or any other go-eyepi process
+func (c *CameraConfig) readStatus() (status captureStatus, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.OutputDir, statusFilename))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &status)
+	return
+}
+
+// addFiles records files written by the capture in progress, a file written again by a retry is only recorded once
+func (c *CameraConfig) addFiles(files ...string) {
+	for _, file := range files {
+		if !stringInSlice(file, c.files) {
+			c.files = append(c.files, file)
+		}
+	}
+}
+
+// takeFiles returns the files written since it was last called
+func (c *CameraConfig) takeFiles() []string {
+	files := c.files
+	c.files = nil
+	return files
+}
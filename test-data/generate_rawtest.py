@@ -0,0 +1,241 @@
+#!/usr/bin/env python3
+# Writes raw/rawtest.dng, a big endian DNG of a 16x8 BGGR sensor with a masked border of two columns on the
+# left. The 14x8 active area has (colour+1)*600 + 4*x + 8*y at x,y of the active area, red 0, green 1, blue 2,
+# the masked border 64. It is 12 bits in two lossless JPEG tiles of 8x8, each encoded as two components like
+# cameras do, with the huffman table of the JPEG standard (T.81 table K.3) and predictor 1.
+#
+# Writes raw/rawtest.cr2, a CR2 of a 14x6 RGGB sensor laid out like Canon does: IFD0 with generated/jpegtest.jpg
+# as the preview and the Exif IFD, whose maker note has the sensor info with the borders of the 10x4 active area
+# at 2,2. The raw IFD follows IFD0 and the header points at it, the raw data is one lossless JPEG of 7x6 in two
+# components, cut into two vertical slices of 4 columns and a last one of 6. The active area has the same
+# values as the DNG, the masked borders 64.
+import os
+import struct
+
+WIDTH, HEIGHT, LEFT, TILE = 16, 8, 2, 8
+PRECISION = 12
+CFA = [[2, 1], [1, 0]]
+
+
+CR2_WIDTH, CR2_HEIGHT = 14, 6
+CR2_SLICES = [2, 4, 6]
+CR2_BORDERS = [2, 2, 11, 5]  # left, top, right, bottom, inclusive
+CR2_CFA = [[0, 1], [1, 2]]
+
+
+def sample(x, y):
+    if x < LEFT:
+        return 64
+    ax = x - LEFT
+    return (CFA[y % 2][ax % 2] + 1) * 600 + 4 * ax + 8 * y
+
+
+def cr2_sample(x, y):
+    left, top, right, bottom = CR2_BORDERS
+    if not (left <= x <= right and top <= y <= bottom):
+        return 64
+    ax, ay = x - left, y - top
+    return (CR2_CFA[ay % 2][ax % 2] + 1) * 600 + 4 * ax + 8 * ay
+
+
+BITS = [0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0]
+VALUES = list(range(12))
+
+
+def huffman_codes():
+    codes, code, k = {}, 0, 0
+    for length, count in enumerate(BITS, 1):
+        for _ in range(count):
+            codes[VALUES[k]] = (code, length)
+            code += 1
+            k += 1
+        code <<= 1
+    return codes
+
+
+class BitWriter:
+    def __init__(self):
+        self.out, self.acc, self.n = bytearray(), 0, 0
+
+    def put(self, value, bits):
+        for i in range(bits - 1, -1, -1):
+            self.acc = self.acc << 1 | (value >> i & 1)
+            self.n += 1
+            if self.n == 8:
+                self.out.append(self.acc)
+                if self.acc == 0xFF:
+                    self.out.append(0)
+                self.acc, self.n = 0, 0
+
+    def flush(self):
+        while self.n:
+            self.put(1, 1)
+
+
+def lossless_jpeg(rows):
+    components, width, height = 2, len(rows[0]) // 2, len(rows)
+    codes = huffman_codes()
+    out = bytearray(b"\xff\xd8")
+    out += struct.pack(">HHB", 0xFFC4, 2 + 1 + 16 + len(VALUES), 0) + bytes(BITS) + bytes(VALUES)
+    out += struct.pack(">HHBHHB", 0xFFC3, 8 + 3 * components, PRECISION, height, width, components)
+    for c in range(components):
+        out += struct.pack(">BBB", c + 1, 0x11, 0)
+    out += struct.pack(">HHB", 0xFFDA, 6 + 2 * components, components)
+    for c in range(components):
+        out += struct.pack(">BB", c + 1, 0)
+    out += struct.pack(">BBB", 1, 0, 0)
+
+    bits = BitWriter()
+    for y in range(height):
+        for x in range(width):
+            for c in range(components):
+                if x == 0 and y == 0:
+                    predicted = 1 << (PRECISION - 1)
+                elif x == 0:
+                    predicted = rows[y - 1][c]
+                else:
+                    predicted = rows[y][(x - 1) * components + c]
+                diff = rows[y][x * components + c] - predicted
+                category = abs(diff).bit_length()
+                code, length = codes[category]
+                bits.put(code, length)
+                if diff < 0:
+                    diff += (1 << category) - 1
+                bits.put(diff, category)
+    bits.flush()
+    return bytes(out + bits.out + b"\xff\xd9")
+
+
+def ifd(entries, at, next_ifd=0, order=">"):
+    """entries are (tag, type, values), values that don't fit the entry follow the IFD"""
+    formats = {1: "B", 2: "B", 3: "H", 4: "I", 7: "B"}
+    head = bytearray(struct.pack(order + "H", len(entries)))
+    extra = bytearray()
+    extra_at = at + 2 + 12 * len(entries) + 4
+    for tag, typ, values in sorted(entries):
+        data = struct.pack(order + "%d%s" % (len(values), formats[typ]), *values)
+        if len(data) > 4:
+            head += struct.pack(order + "HHII", tag, typ, len(values), extra_at + len(extra))
+            extra += data + b"\0" * (len(data) % 2)
+        else:
+            head += struct.pack(order + "HHI", tag, typ, len(values)) + data.ljust(4, b"\0")
+    head += struct.pack(order + "I", next_ifd)
+    return bytes(head + extra)
+
+
+def write(name, data):
+    path = os.path.join(os.path.dirname(os.path.abspath(__file__)), "raw", name)
+    os.makedirs(os.path.dirname(path), exist_ok=True)
+    with open(path, "wb") as f:
+        f.write(data)
+
+
+def dng():
+    tiles = [lossless_jpeg([[sample(tile_x + x, y) for x in range(TILE)] for y in range(HEIGHT)])
+             for tile_x in range(0, WIDTH, TILE)]
+    thumbnail = bytes([128] * 2 * 2 * 3)
+
+    def ifd0(raw_at, data_at):
+        return [
+            (254, 4, [1]),  # NewSubfileType, a thumbnail
+            (256, 4, [2]),
+            (257, 4, [2]),
+            (258, 3, [8, 8, 8]),
+            (259, 3, [1]),
+            (262, 3, [2]),  # RGB
+            (273, 4, [data_at]),
+            (277, 3, [3]),
+            (278, 4, [2]),
+            (279, 4, [len(thumbnail)]),
+            (330, 4, [raw_at]),  # SubIFDs
+            (50706, 1, [1, 4, 0, 0]),  # DNGVersion
+            (50708, 2, list(b"go-eyepi\0")),  # UniqueCameraModel
+        ]
+
+    def raw(tiles_at):
+        return [
+            (254, 4, [0]),
+            (256, 4, [WIDTH]),
+            (257, 4, [HEIGHT]),
+            (258, 3, [PRECISION]),
+            (259, 3, [7]),  # lossless JPEG
+            (262, 3, [32803]),  # CFA
+            (322, 4, [TILE]),
+            (323, 4, [HEIGHT]),
+            (324, 4, tiles_at),
+            (325, 4, [len(t) for t in tiles]),
+            (33421, 3, [2, 2]),  # CFARepeatPatternDim
+            (33422, 1, [2, 1, 1, 0]),  # CFAPattern
+            (50717, 3, [4095]),  # WhiteLevel
+            (50829, 3, [0, LEFT, HEIGHT, WIDTH]),  # ActiveArea
+        ]
+
+    # the header, IFD0 with the thumbnail, the raw IFD, the thumbnail and the tiles, the sizes of the IFDs
+    # don't depend on the offsets in them
+    raw_at = 8 + len(ifd(ifd0(0, 0), 0))
+    data_at = raw_at + len(ifd(raw([0, 0]), 0))
+    tiles_at = [data_at + len(thumbnail), data_at + len(thumbnail) + len(tiles[0])]
+    out = b"MM\0\x2a" + struct.pack(">I", 8) + ifd(ifd0(raw_at, data_at), 8) + ifd(raw(tiles_at), raw_at)
+    assert len(out) == data_at
+    out += thumbnail + tiles[0] + tiles[1]
+    write("rawtest.dng", out)
+
+
+def cr2():
+    # the samples one slice after the other, every slice from top to bottom, in rows of the JPEG
+    count, width, last = CR2_SLICES
+    stream = []
+    for slice_x in range(0, CR2_WIDTH, width):
+        slice_width = width if slice_x < count * width else last
+        for y in range(CR2_HEIGHT):
+            stream += [cr2_sample(slice_x + x, y) for x in range(slice_width)]
+    raw_data = lossless_jpeg([stream[y * CR2_WIDTH:(y + 1) * CR2_WIDTH] for y in range(CR2_HEIGHT)])
+    with open(os.path.join(os.path.dirname(os.path.abspath(__file__)), "generated", "jpegtest.jpg"), "rb") as f:
+        preview = f.read()
+
+    def ifd0(exif_at, preview_at):
+        return [
+            (259, 3, [6]),  # old style JPEG
+            (273, 4, [preview_at]),
+            (279, 4, [len(preview)]),
+            (34665, 4, [exif_at]),  # ExifIFD
+        ]
+
+    def maker_note():
+        info = [34, CR2_WIDTH, CR2_HEIGHT, 0, 0] + CR2_BORDERS + [0] * 8
+        return [(0xE0, 3, info)]  # SensorInfo
+
+    def exif(exif_at):
+        # the maker note follows the Exif IFD, its offsets are from the start of the file
+        note_at = exif_at + 2 + 12 + 4
+        return [(37500, 7, list(ifd(maker_note(), note_at, order="<")))]  # MakerNote
+
+    def raw(data_at):
+        return [
+            (259, 3, [6]),
+            (273, 4, [data_at]),
+            (279, 4, [len(raw_data)]),
+            (50752, 3, CR2_SLICES),  # CR2Slices
+        ]
+
+    # the header, IFD0, the Exif IFD with the maker note, the raw IFD, the preview and the raw data, the sizes
+    # of the IFDs don't depend on the offsets in them
+    exif_at = 16 + len(ifd(ifd0(0, 0), 0, order="<"))
+    raw_at = exif_at + len(ifd(exif(exif_at), exif_at, order="<"))
+    preview_at = raw_at + len(ifd(raw(0), 0, order="<"))
+    data_at = preview_at + len(preview)
+    out = b"II\x2a\0" + struct.pack("<I", 16) + b"CR\x02\0" + struct.pack("<I", raw_at)
+    out += ifd(ifd0(exif_at, preview_at), 16, raw_at, order="<")
+    out += ifd(exif(exif_at), exif_at, order="<") + ifd(raw(data_at), raw_at, order="<")
+    assert len(out) == preview_at
+    out += preview + raw_data
+    write("rawtest.cr2", out)
+
+
+def main():
+    dng()
+    cr2()
+
+
+if __name__ == "__main__":
+    main()
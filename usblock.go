@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//USBLOCKPATH is the lock file shared by every go-eyepi process that talks to the cameras,
+//every bus has a lock file next to it, eg /var/lock/eyepi-usb-001.lock
+const USBLOCKPATH = "/var/lock/eyepi-usb.lock"
+
+//usbLockManager serialises gphoto2 calls per USB bus, so that cameras on separate buses can capture in parallel.
+//gphoto2 --auto-detect probes every bus, it takes the global lock which excludes all of them.
+//The locks are held within this process and, through flocks, with other go-eyepi processes like the operator commands.
+type usbLockManager struct {
+	path string
+	// all is held for reading by bus locks and for writing by lockAll
+	all   sync.RWMutex
+	mu    sync.Mutex
+	buses map[string]*sync.Mutex
+}
+
+func newUsbLockManager(path string) *usbLockManager {
+	return &usbLockManager{path: path, buses: make(map[string]*sync.Mutex)}
+}
+
+// usbBus returns the bus of a gphoto2 port like usb:001,006, other ports are their own bus
+func usbBus(port string) string {
+	if m := usbRegexp.FindStringSubmatch(port); m != nil {
+		return m[1]
+	}
+	return port
+}
+
+// busPath returns the lock file of a bus
+func (l *usbLockManager) busPath(bus string) string {
+	return strings.TrimSuffix(l.path, ".lock") + "-" + strings.Replace(bus, "/", "_", -1) + ".lock"
+}
+
+func (l *usbLockManager) bus(bus string) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, exists := l.buses[bus]; !exists {
+		l.buses[bus] = &sync.Mutex{}
+	}
+	return l.buses[bus]
+}
+
+// lockBuses locks the buses of ports, returning the function that unlocks them and how long it waited
+func (l *usbLockManager) lockBuses(ports ...string) (unlock func(), waited time.Duration) {
+	start := time.Now()
+	// always in the same order so that two groups sharing buses can't deadlock
+	var buses []string
+	for _, port := range ports {
+		if bus := usbBus(port); !stringInSlice(bus, buses) {
+			buses = append(buses, bus)
+		}
+	}
+	sort.Strings(buses)
+
+	l.all.RLock()
+	files := []*os.File{flock(l.path, syscall.LOCK_SH)}
+	var mutexes []*sync.Mutex
+	for _, bus := range buses {
+		m := l.bus(bus)
+		m.Lock()
+		mutexes = append(mutexes, m)
+		files = append(files, flock(l.busPath(bus), syscall.LOCK_EX))
+	}
+	return func() {
+		for i := len(files) - 1; i >= 0; i-- {
+			funlock(files[i])
+			if i > 0 {
+				mutexes[i-1].Unlock()
+			}
+		}
+		l.all.RUnlock()
+	}, time.Since(start)
+}
+
+// lockAll locks every bus, for gphoto2 calls that probe all of them
+func (l *usbLockManager) lockAll() (unlock func()) {
+	l.all.Lock()
+	file := flock(l.path, syscall.LOCK_EX)
+	return func() {
+		funlock(file)
+		l.all.Unlock()
+	}
+}
+
+// flock opens the lock file at path and waits for the lock, closing the file releases it.
+// If the lock file can't be used it returns nil and the lock only works within this process.
+func flock(path string, how int) *os.File {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		warnLog.Printf("cannot open usb lock %s, not coordinating with other processes: %s\n", path, err)
+		return nil
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		infoLog.Printf("waiting for another go-eyepi process to release %s\n", path)
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != nil {
+			warnLog.Printf("cannot lock %s: %s\n", path, err)
+		}
+	}
+	return f
+}
+
+func funlock(f *os.File) {
+	if f != nil {
+		f.Close()
+	}
+}
+
+// takeLockWait returns the time the camera waited for usb locks since it was last called
+func (c *CameraConfig) takeLockWait() time.Duration {
+	waited := c.lockWait
+	c.lockWait = 0
+	return waited
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usbSettleTime is how long a camera gets to come back on the bus after every recovery step
+const usbSettleTime = time.Duration(time.Second * 5)
+
+//sysfsDevice is a USB device in sysfs, named by its place in the tree of hubs like 3-1.2 (bus 3, hub port 1, port 2)
+type sysfsDevice struct {
+	root, name string
+	// pause is how long an attribute stays off when it is toggled
+	pause time.Duration
+}
+
+// findSysfsDevice returns the sysfs device of a gphoto2 port like usb:003,003, under the sysfs root
+func findSysfsDevice(root, port string) (sysfsDevice, error) {
+	m := usbRegexp.FindStringSubmatch(port)
+	if m == nil {
+		return sysfsDevice{}, fmt.Errorf("%s is not a usb port", port)
+	}
+	bus, _ := strconv.Atoi(m[1])
+	dev, _ := strconv.Atoi(m[2])
+
+	devices := filepath.Join(root, "bus", "usb", "devices")
+	entries, err := ioutil.ReadDir(devices)
+	if err != nil {
+		return sysfsDevice{}, err
+	}
+	for _, entry := range entries {
+		// interfaces of the devices are listed with them, eg 3-1.2:1.0
+		if strings.Contains(entry.Name(), ":") {
+			continue
+		}
+		env, err := getEventFromUEventFile(filepath.Join(devices, entry.Name(), "uevent"))
+		if err != nil {
+			continue
+		}
+		busNum, _ := strconv.Atoi(env["BUSNUM"])
+		devNum, _ := strconv.Atoi(env["DEVNUM"])
+		if env["DEVTYPE"] == "usb_device" && busNum == bus && devNum == dev {
+			return sysfsDevice{root: root, name: entry.Name()}, nil
+		}
+	}
+	return sysfsDevice{}, fmt.Errorf("no usb device for %s in %s", port, devices)
+}
+
+func (d sysfsDevice) path(elem ...string) string {
+	return filepath.Join(append([]string{d.root, "bus", "usb", "devices", d.name}, elem...)...)
+}
+
+// toggle writes off and then on to a sysfs attribute, pausing in between
+func (d sysfsDevice) toggle(path, off, on string) error {
+	if err := ioutil.WriteFile(path, []byte(off), 0644); err != nil {
+		return err
+	}
+	time.Sleep(d.pause)
+	return ioutil.WriteFile(path, []byte(on), 0644)
+}
+
+// reauthorize disconnects the device logically and lets the kernel enumerate it again
+func (d sysfsDevice) reauthorize() error {
+	return d.toggle(d.path("authorized"), "0", "1")
+}
+
+// rebind unbinds the device from its driver and binds it again
+func (d sysfsDevice) rebind() error {
+	driver, err := filepath.EvalSymlinks(d.path("driver"))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(driver, "unbind"), []byte(d.name), 0644); err != nil {
+		return err
+	}
+	time.Sleep(d.pause)
+	return ioutil.WriteFile(filepath.Join(driver, "bind"), []byte(d.name), 0644)
+}
+
+// portPowerPath returns the attribute that switches off the hub port the device is plugged into,
+// eg 3-1/3-1:1.0/3-1-port2/disable for 3-1.2 and usb3/3-0:1.0/usb3-port1/disable for 3-1
+func (d sysfsDevice) portPowerPath() string {
+	hub, port := d.name[:strings.LastIndex(d.name, ".")+1], ""
+	if hub == "" {
+		// plugged into the root hub of the bus
+		dash := strings.Index(d.name, "-")
+		bus := d.name[:dash]
+		hub, port = "usb"+bus, d.name[dash+1:]
+		return filepath.Join(d.root, "bus", "usb", "devices", hub, bus+"-0:1.0", hub+"-port"+port, "disable")
+	}
+	hub, port = strings.TrimSuffix(hub, "."), d.name[len(hub):]
+	return filepath.Join(d.root, "bus", "usb", "devices", hub, hub+":1.0", hub+"-port"+port, "disable")
+}
+
+// powerCycle switches the hub port of the device off and on, if the hub supports it
+func (d sysfsDevice) powerCycle() error {
+	path := d.portPowerPath()
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("the hub doesn't switch port power: %s", err)
+	}
+	return d.toggle(path, "1", "0")
+}
+
+// recoverUsbDevice tries to bring back the wedged camera on device d, with every step more drastic than the last:
+// reauthorizing the device, rebinding its driver and power cycling its hub port. port is the last one it was
+// found on, its bus is locked during every step.
+// After every step it waits settle and asks found whether the camera is back.
+func recoverUsbDevice(ctx context.Context, d sysfsDevice, port string, pause, settle time.Duration, found func() bool) error {
+	d.pause = pause
+	var failed []string
+	for _, step := range []struct {
+		name string
+		run  func() error
+	}{
+		{"reauthorizing", d.reauthorize},
+		{"rebinding", d.rebind},
+		{"power cycling", d.powerCycle},
+	} {
+		infoLog.Printf("recovering usb device %s by %s it\n", d.name, step.name)
+		// other cameras on the bus are disturbed too, keep them from capturing meanwhile
+		unlock, _ := usbLocks.lockBuses(port)
+		err := step.run()
+		unlock()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", step.name, err))
+			continue
+		}
+		select {
+		case <-time.After(settle):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if found() {
+			infoLog.Printf("usb device %s recovered by %s it\n", d.name, step.name)
+			return nil
+		}
+		failed = append(failed, step.name+" didn't bring it back")
+	}
+	return fmt.Errorf("could not recover usb device %s: %s", d.name, strings.Join(failed, ", "))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+//configProblems lists everything that is wrong with a configuration file
+type configProblems []string
+
+func (p configProblems) Error() string {
+	return strings.Join(p, "\n")
+}
+
+func (p *configProblems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+//configValidator is implemented by cameras with settings of their own to check
+type configValidator interface {
+	validate() []string
+}
+
+//deviceIdentifier is implemented by cameras that are matched to a physical device, no two cameras may claim the same one
+type deviceIdentifier interface {
+	deviceID() string
+}
+
+// validate returns the problems with the settings shared by every camera type
+func (c *CameraConfig) validate() (problems []string) {
+	if c.Latitude < -90 || c.Latitude > 90 || c.Longitude < -180 || c.Longitude > 180 {
+		problems = append(problems, fmt.Sprintf("latitude %f and longitude %f are out of range", c.Latitude, c.Longitude))
+	}
+	if (!c.CaptureFrom.isZero() || !c.CaptureUntil.isZero()) && c.Latitude == 0 && c.Longitude == 0 {
+		problems = append(problems, "capturefrom and captureuntil need the latitude and longitude of the camera")
+	}
+	if c.CaptureTimeout.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("capturetimeout must not be negative, got %s", c.CaptureTimeout))
+	}
+	if c.Retries < 0 {
+		problems = append(problems, fmt.Sprintf("retries must not be negative, got %d", c.Retries))
+	}
+	if !c.StartDate.IsZero() && !c.EndDate.IsZero() && !c.EndDate.end().After(c.StartDate.Time) {
+		problems = append(problems, fmt.Sprintf("enddate %s is before startdate %s", c.EndDate, c.StartDate))
+	}
+	for _, b := range c.Blackouts {
+		if b.From.IsZero() || b.Until.IsZero() || !b.Until.end().After(b.From.Time) {
+			problems = append(problems, fmt.Sprintf("blackout from %s until %s is empty", b.From, b.Until))
+		}
+	}
+	return
+}
+
+// checkWritable creates dir if it doesn't exist and checks that files can be written to it
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".eyepi-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// validateConfig checks the settings of a loaded configuration, returning every problem as configProblems
+func validateConfig(c *GlobalConfig) error {
+	var problems configProblems
+	if c.ShutdownGrace.Duration < 0 {
+		problems.add("shutdowngrace must not be negative, got %s", c.ShutdownGrace)
+	}
+
+	names := make([]string, 0, len(c.Cameras))
+	for name := range c.Cameras {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prefixes := make(map[string]string)
+	devices := make(map[string]string)
+	outputDirs := make(map[string]error)
+	for _, name := range names {
+		cam := c.Cameras[name]
+		cameraProblems := cam.Config().validate()
+		if v, ok := cam.(configValidator); ok {
+			cameraProblems = append(cameraProblems, v.validate()...)
+		}
+		for _, problem := range cameraProblems {
+			problems.add("%s: %s", name, problem)
+		}
+
+		prefix := cam.Config().FilenamePrefix
+		if other, exists := prefixes[prefix]; exists {
+			problems.add("%s: filenameprefix %s is also used by %s", name, prefix, other)
+		}
+		prefixes[prefix] = name
+
+		if d, ok := cam.(deviceIdentifier); ok && d.deviceID() != "" {
+			if other, exists := devices[d.deviceID()]; exists {
+				problems.add("%s: %s is also used by %s", name, d.deviceID(), other)
+			}
+			devices[d.deviceID()] = name
+		}
+
+		dir := cam.Config().OutputDir
+		if _, checked := outputDirs[dir]; !checked {
+			outputDirs[dir] = checkWritable(dir)
+		}
+		if err := outputDirs[dir]; err != nil {
+			problems.add("%s: outputdir is not writable: %s", name, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// checkConfigFile loads and validates the configuration file at path, returning every problem found
+func checkConfigFile(path string) configProblems {
+	c, err := loadConfig(path)
+	problems, isProblems := err.(configProblems)
+	if err != nil && !isProblems {
+		return configProblems{err.Error()}
+	}
+	if c == nil {
+		return problems
+	}
+	if err := validateConfig(c); err != nil {
+		problems = append(problems, err.(configProblems)...)
+	}
+	return problems
+}